@@ -23,23 +23,39 @@ package main
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
+	"text/template"
 	"time"
 
 	"github.com/james-orcales/golang_snacks/invariant"
@@ -48,22 +64,13 @@ import (
 
 var (
 	HOME = filepath.Clean(os.Getenv("HOME"))
+	// Relative entries are kept so env doctor can report them. Every other command refuses to start with them, see
+	// environment_problems.
 	PATH = func() []string {
-		raw_path := os.Getenv("PATH")
-		path := filepath.SplitList(raw_path)
-		invariant.Always(len(path) > 0, "it's impossible that the PATH is empty innit?")
-		invariant.Always(
-			func() bool {
-				for i, entry := range path {
-					if !filepath.IsAbs(entry) {
-						return false
-					}
-					path[i] = filepath.Clean(entry)
-				}
-				return true
-			}(),
-			"All PATH entries are absolute paths",
-		)
+		path := filepath.SplitList(os.Getenv("PATH"))
+		for i, entry := range path {
+			path[i] = filepath.Clean(entry)
+		}
 		return path
 	}()
 
@@ -73,30 +80,96 @@ var (
 	BIG_BANG_MAN      = filepath.Clean(os.Getenv("BIG_BANG_MAN"))
 	BIG_BANG_BIN      = filepath.Clean(os.Getenv("BIG_BANG_BIN"))
 	BIG_BANG_TMP      = filepath.Clean(os.Getenv("BIG_BANG_TMP"))
-	// A mirror of the home directory but only hosts dotfiles.
-	big_bang_dotfiles_root        = filepath.Join(BIG_BANG_GIT_DIR, "dotfiles")
-	big_bang_dotfiles_common      = filepath.Join(big_bang_dotfiles_root, "common")
-	big_bang_dotfiles_os_specific = func() string {
-		switch runtime.GOOS {
-		case "darwin":
-			return filepath.Join(big_bang_dotfiles_root, "macos")
-		case "linux":
-			return filepath.Join(big_bang_dotfiles_root, "debian")
-		default:
-			fmt.Println("unsupported os")
-			os.Exit(1)
-		}
-		return ""
-	}()
+	// A mirror of the home directory but only hosts dotfiles. It's split into layers, see dotfile_layers.
+	big_bang_dotfiles_root = filepath.Join(BIG_BANG_GIT_DIR, "dotfiles")
+
+	// The working directory big_bang was started from, before it changes into BIG_BANG_DATA_DIR. Relative paths given on
+	// the command line are resolved against it.
+	invocation_dir string
 
 	CARGO_HOME           = filepath.Clean(os.Getenv("CARGO_HOME"))
 	RUSTUP_HOME          = filepath.Clean(os.Getenv("RUSTUP_HOME"))
+	GOPATH               = filepath.Clean(os.Getenv("GOPATH"))
 	HOMEBREW_BUNDLE_FILE = filepath.Clean(os.Getenv("HOMEBREW_BUNDLE_FILE"))
 )
 
 // TODO: Have checksums for artifacts list and homebrew list where you're forced to update these
 // manually just like with nix. This would need type Artifact to implement Stringer
 func main() {
+	os.Exit(big_bang(os.Args[1:]))
+}
+
+const usage = `usage: go run big_bang.go [command]
+
+With no command, installs every artifact, syncs dotfiles, and applies system preferences.
+
+commands:
+  install [--output=json] [--trace=<file>]
+                                 only install artifacts. --output=json streams JSON-lines events to stdout instead of the
+                                 summary. --trace writes a Chrome trace-event file, viewable in chrome://tracing or Perfetto
+  sync [--output=json] [--trace=<file>] [--yes] [--diff] [--conflict=ask|merge|mine|theirs] [--list]
+                                 only sync dotfiles. --diff prints the diff first and asks before writing when interactive.
+                                 dotfiles removed from the repo are deleted from HOME if they still hold what big_bang
+                                 wrote. you're asked first unless --yes is given. edited ones are kept.
+                                 dotfiles edited locally are never overwritten. if the repo changed them too, --conflict
+                                 picks between a three-way merge with conflict markers, keeping yours, or taking the repo's.
+                                 the default asks, or skips them when nobody can be asked. --list only prints the dotfiles a
+                                 sync considers, after ignore files are applied
+  status [--output=json]         list the artifacts and dotfiles recorded in the state file
+  check [--output=json]          report what a run would change without changing anything. exits 1 if there is work to do
+  history [run]                  list past runs and their outcome, or print the logs of every run whose id starts with run
+                                 output of the commands run for each artifact is kept in BIG_BANG_DATA_DIR/logs/<run>/
+  encrypt <path> [--layer=<layer>] [--force]
+                                 encrypt a file from HOME into a dotfile layer (default common) as <path>.enc
+  explain <path...>              show which dotfile layer provides each file in HOME, and which layers it overrides
+  diff [path...]                 print a unified diff of what a sync would write to each dotfile in HOME, or only to the
+                                 given ones
+  restore <run> [path...]        copy the dotfiles backed up during a run back into HOME. without paths, restores all of
+                                 them. run is a backup id from backups list or a prefix that matches exactly one
+  backups list                   list the runs that backed up dotfiles before overwriting or deleting them
+  backups prune [--keep=<n>] [--max-age=<days>] [--yes]
+                                 delete all but the newest n backups (default 10) and any older than the given age
+  verify                         re-hash installed files and report drift from what was recorded at install time
+  uninstall <artifact> [--purge]
+                                 remove the files recorded when the artifact was installed. --purge also drops cached
+                                 downloads. artifacts with a custom install step (brew, cargo) aren't recorded and can't be
+                                 uninstalled
+  gc [--yes]                     delete files in BIG_BANG_BIN, BIG_BANG_SHARE, and BIG_BANG_MAN that no artifact owns
+  env doctor                     check the BIG_BANG directories, PATH, MANPATH, and toolchain directories for shadowed
+                                 binaries and misconfiguration. runs even when the environment is too broken for the rest
+
+environment:
+  BIG_BANG_PROFILES              comma-separated names of dotfile layers under dotfiles/profiles/ applied after the others
+  BIG_BANG_LOG_LEVEL             console log level: debug, info, warn, or error. defaults to info
+  BIG_BANG_LOG_FILE_LEVEL        level of the log kept for every run under BIG_BANG_DATA_DIR/logs. defaults to debug
+  BIG_BANG_LOG_KEEP              number of run logs kept. older ones are deleted when a run starts. defaults to 100
+  BIG_BANG_LOG_MAX_AGE           days a run log is kept. defaults to 90
+
+dotfiles ending in .tmpl are rendered with text/template and written without the suffix. the template data is described
+by Template_Vars in big_bang.go. machine-specific values go in BIG_BANG_DATA_DIR/vars.json and are available as .Local.
+dotfiles ending in .enc are decrypted and written with mode 0600. the passphrase is read from
+BIG_BANG_DATA_DIR/dotfiles.key, which only its owner may access, or asked for. their contents are never shown by diff.
+files ignored by the repo's .gitignore files or by a .bigbangignore at the top of a layer are never synced.
+
+exit status:
+  0  everything succeeded
+  1  something failed. a run prints a summary of which artifacts and dotfiles failed
+  2  invalid command or flags
+  3  the environment exported by bootstrap.lua is incomplete or invalid, see env doctor, or the state file is unreadable
+
+json output:
+  every document and event carries schema_version. it is bumped when a field is renamed, removed, or changes meaning.
+  event types: phase_begin, phase_done, span, outcome, download, dotfile_write, run_done. logs go to stderr.`
+
+// Documented in usage. Wrapper scripts depend on these so don't renumber them.
+const (
+	exit_ok      = 0
+	exit_failure = 1
+	exit_usage   = 2
+	exit_setup   = 3
+)
+
+func big_bang(arguments []string) (exit_code int) {
 	invariant.Always(runtime.Version() == "go1.25.3", "Only one go version is supported")
 	switch runtime.GOOS {
 	case "windows":
@@ -115,57 +188,141 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The doctor diagnoses the same misconfigurations that the setup below refuses to start with, so it runs first.
+	if len(arguments) == 2 && arguments[0] == "env" && arguments[1] == "doctor" {
+		return command_env_doctor(itlog.New(os.Stdout, itlog.LevelInfo))
+	}
+
 	err_setup := func() error {
-		invariant.Always(
-			func() bool {
-				for _, dir := range []string{
-					BIG_BANG_GIT_DIR,
-					BIG_BANG_DATA_DIR,
-					BIG_BANG_SHARE,
-					BIG_BANG_MAN,
-					BIG_BANG_BIN,
-				} {
-					if !filepath.IsAbs(dir) || !dir_exists(dir) {
-						return false
-					}
-				}
-				return true
-			}(),
-			"Essential directories are created and exported during bootstrap.lua",
-		)
-		invariant.Always(strings.Contains(BIG_BANG_GIT_DIR, "james-orcales/code/big_bang"), "Repo is cloned into ~/code/big_bang")
+		if problems := environment_problems(); len(problems) > 0 {
+			return fmt.Errorf("%s. run `env doctor` for details", strings.Join(problems, "; "))
+		}
 
-		if err := os.RemoveAll(BIG_BANG_TMP); err != nil {
-			return err
+		var err error
+		if console_log_level, err = parse_log_level(os.Getenv("BIG_BANG_LOG_LEVEL"), itlog.LevelInfo); err != nil {
+			return fmt.Errorf("BIG_BANG_LOG_LEVEL: %w", err)
 		}
-		if err := os.MkdirAll(BIG_BANG_TMP, 0o755); err != nil {
-			return err
+		if file_log_level, err = parse_log_level(os.Getenv("BIG_BANG_LOG_FILE_LEVEL"), itlog.LevelDebug); err != nil {
+			return fmt.Errorf("BIG_BANG_LOG_FILE_LEVEL: %w", err)
+		}
+		if run_log_keep_count, err = parse_positive_int(os.Getenv("BIG_BANG_LOG_KEEP"), 100); err != nil {
+			return fmt.Errorf("BIG_BANG_LOG_KEEP: %w", err)
+		}
+		max_age_days, err := parse_positive_int(os.Getenv("BIG_BANG_LOG_MAX_AGE"), 90)
+		if err != nil {
+			return fmt.Errorf("BIG_BANG_LOG_MAX_AGE: %w", err)
 		}
+		run_log_max_age = time.Hour * 24 * time.Duration(max_age_days)
 
+		if invocation_dir, err = os.Getwd(); err != nil {
+			return err
+		}
 		// Just a safety measure in case I mess up paths. I still use absolute paths for everything.
 		if err := os.Chdir(BIG_BANG_DATA_DIR); err != nil {
 			return err
 		}
 		return nil
 	}()
-	defer os.RemoveAll(BIG_BANG_TMP)
 
-	if len(os.Args) > 1 {
-		fmt.Println("This script does not support any arguments or flags")
-		return
-	}
-	lgr := itlog.New(os.Stdout, itlog.LevelInfo)
+	lgr := itlog.New(os.Stdout, console_log_level)
 	if err_setup != nil {
 		lgr.Error(err_setup).Msg("initiliazing environment")
-		return
+		return exit_setup
+	}
+	// Only installing uses BIG_BANG_TMP. Other commands leave it alone since it could belong to an install running in
+	// another terminal.
+	if len(arguments) == 0 || strings.HasPrefix(arguments[0], "-") || arguments[0] == "install" {
+		err := os.RemoveAll(BIG_BANG_TMP)
+		if err == nil {
+			err = os.MkdirAll(BIG_BANG_TMP, 0o755)
+		}
+		if err != nil {
+			lgr.Error(err).Str("dir", BIG_BANG_TMP).Msg("resetting temporary directory")
+			return exit_setup
+		}
+		defer os.RemoveAll(BIG_BANG_TMP)
+	}
+	state, err := load_state()
+	if err != nil {
+		lgr.Error(err).Str("file", state_file_path()).Msg("loading installed state")
+		return exit_setup
+	}
+
+	switch {
+	case len(arguments) == 0 || strings.HasPrefix(arguments[0], "-"):
+		return command_run(state, lgr, "", arguments)
+	case arguments[0] == "install" || arguments[0] == "sync":
+		return command_run(state, lgr, arguments[0], arguments[1:])
+	case arguments[0] == "status":
+		return command_status(state, lgr, arguments[1:])
+	case arguments[0] == "check":
+		return command_check(state, lgr, arguments[1:])
+	case arguments[0] == "encrypt":
+		return command_encrypt(lgr, arguments[1:])
+	case arguments[0] == "explain":
+		return command_explain(lgr, arguments[1:])
+	case arguments[0] == "diff":
+		return command_diff(lgr, arguments[1:])
+	case arguments[0] == "restore":
+		return command_restore(lgr, arguments[1:])
+	case arguments[0] == "backups" && len(arguments) >= 2 && arguments[1] == "list":
+		return command_backups_list(lgr, arguments[2:])
+	case arguments[0] == "backups" && len(arguments) >= 2 && arguments[1] == "prune":
+		return command_backups_prune(lgr, arguments[2:])
+	case arguments[0] == "history":
+		return command_history(lgr, arguments[1:])
+	case arguments[0] == "verify" && len(arguments) == 1:
+		return command_verify(state, lgr)
+	case arguments[0] == "uninstall":
+		return command_uninstall(state, lgr, arguments[1:])
+	case arguments[0] == "gc":
+		return command_gc(state, lgr, arguments[1:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+}
+
+// Misconfigurations of the environment, most of it exported by bootstrap.lua, that big_bang can't run with.
+func environment_problems() (problems []string) {
+	if len(PATH) == 0 {
+		problems = append(problems, "PATH is empty")
+	}
+	for _, entry := range PATH {
+		if !filepath.IsAbs(entry) {
+			problems = append(problems, fmt.Sprintf("PATH entry %q is not an absolute path", entry))
+		}
 	}
+	for _, dir := range []struct{ name, path string }{
+		{"BIG_BANG_GIT_DIR", BIG_BANG_GIT_DIR},
+		{"BIG_BANG_DATA_DIR", BIG_BANG_DATA_DIR},
+		{"BIG_BANG_SHARE", BIG_BANG_SHARE},
+		{"BIG_BANG_MAN", BIG_BANG_MAN},
+		{"BIG_BANG_BIN", BIG_BANG_BIN},
+	} {
+		switch {
+		case !filepath.IsAbs(dir.path):
+			problems = append(problems, fmt.Sprintf("%s is not set to an absolute path", dir.name))
+		case !dir_exists(dir.path):
+			problems = append(problems, fmt.Sprintf("%s=%s does not exist", dir.name, dir.path))
+		}
+	}
+	if _, err := parse_profiles(os.Getenv("BIG_BANG_PROFILES")); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if !strings.Contains(BIG_BANG_GIT_DIR, "james-orcales/code/big_bang") {
+		problems = append(problems, fmt.Sprintf("BIG_BANG_GIT_DIR=%s is not the repo cloned into ~/code/big_bang", BIG_BANG_GIT_DIR))
+	}
+	return problems
+}
 
-	// === Execution ===
+// The artifacts big_bang manages, validated and with their Checkhealth set.
+func artifact_manifest() map[string]Artifact {
 	// TODO: man pages. `foo.1-8``
 	artifacts := map[string]Artifact{
 		"brew": {
 			Name: "brew",
-			Checkhealth: func() error {
+			Checkhealth: func(_ context.Context) error {
 				if runtime.GOOS != "darwin" {
 					return nil
 				}
@@ -177,7 +334,7 @@ func main() {
 				}
 				return nil
 			},
-			Install: func(lgr *itlog.Logger) {
+			Install: func(lgr *itlog.Logger, output io.Writer) {
 				if runtime.GOOS != "darwin" {
 					return
 				}
@@ -197,7 +354,7 @@ func main() {
 				)
 				lgr.Info().Msg("wrote HOMEBREW_BUNDLE_FILE")
 				lgr.Info().Begin("installing homebrew")
-				err := spawn("", []string{"NONINTERACTIVE=1"},
+				err := spawn(output, "", []string{"NONINTERACTIVE=1"},
 					"/bin/bash",
 					"-c",
 					pipe(
@@ -211,7 +368,7 @@ func main() {
 				} else {
 					lgr.Info().Done("installing homebrew")
 					lgr.Info().Begin("installing brew bundle")
-					if err := spawn("", nil, "brew", "bundle", "install"); err != nil {
+					if err := spawn(output, "", nil, "brew", "bundle", "install"); err != nil {
 						return
 					}
 					lgr.Info().Done("installing brew bundle")
@@ -220,9 +377,13 @@ func main() {
 		},
 		"cargo": {
 			Name: "cargo",
-			Checkhealth: func() error {
-				invariant.Always(strings.HasPrefix(RUSTUP_HOME, BIG_BANG_SHARE), "RUSTUP_HOME is set inside BIG_BANG_SHARE")
-				invariant.Always(strings.HasPrefix(CARGO_HOME, BIG_BANG_SHARE), "CARGO_HOME is set inside BIG_BANG_SHARE")
+			Checkhealth: func(_ context.Context) error {
+				if !path_is_within(BIG_BANG_SHARE, RUSTUP_HOME) {
+					return fmt.Errorf("RUSTUP_HOME=%s is not inside BIG_BANG_SHARE", RUSTUP_HOME)
+				}
+				if !path_is_within(BIG_BANG_SHARE, CARGO_HOME) {
+					return fmt.Errorf("CARGO_HOME=%s is not inside BIG_BANG_SHARE", CARGO_HOME)
+				}
 
 				path_cargo := which("cargo")
 				path_rustup := which("rustup")
@@ -230,21 +391,21 @@ func main() {
 				if path_cargo == "" {
 					return fmt.Errorf("cargo is not installed")
 				} else if !strings.HasPrefix(path_cargo, BIG_BANG_DATA_DIR) {
-					return fmt.Errorf("cargo installation is not inside BIG_BANG_DATA_DIR")
+					return not_managed_error("cargo", path_cargo)
 				}
 				if path_rustup == "" {
 					return fmt.Errorf("rustup is not installed")
 				} else if !strings.HasPrefix(path_rustup, BIG_BANG_DATA_DIR) {
-					return fmt.Errorf("rustup installation is not inside BIG_BANG_DATA_DIR")
+					return not_managed_error("rustup", path_rustup)
 				}
 				if path_rustc == "" {
 					return fmt.Errorf("rustc is not installed")
 				} else if !strings.HasPrefix(path_rustc, BIG_BANG_DATA_DIR) {
-					return fmt.Errorf("rustc installation is not inside BIG_BANG_DATA_DIR")
+					return not_managed_error("rustc", path_rustc)
 				}
 				return nil
 			},
-			Install: func(lgr *itlog.Logger) {
+			Install: func(lgr *itlog.Logger, output io.Writer) {
 				lgr.Info().Begin("installing cargo")
 				script := pipe(
 					"curl",
@@ -255,7 +416,7 @@ func main() {
 					"--fail",
 					"https://sh.rustup.rs",
 				)
-				err := spawn("", nil,
+				err := spawn(output, "", nil,
 					"sh", "-c", script,
 					"foo.sh", // This becomes $0 to script
 					"-y",
@@ -271,29 +432,16 @@ func main() {
 		},
 		// Fish does not have official darwin binary releases because no one on the team uses MacOS.
 		"fish": {
-			Name:    "fish",
-			Version: "fish, version 4.0.2",
-			Install: func(lgr *itlog.Logger) {
-				invariant.Always(strings.HasPrefix(which("cargo"), BIG_BANG_DATA_DIR), "cargo is installed")
-				invariant.Always(filepath.IsAbs(which("git")), "git executable path is absolute")
-
-				lgr.Info().Begin("installing fish")
-				tmp_dir := filepath.Join(BIG_BANG_TMP, "fish-shell")
-				if err := spawn("", nil,
-					"git", "clone", "--quiet", "--depth=1", "--branch=4.0.2", "https://github.com/fish-shell/fish-shell/", tmp_dir,
-				); err != nil {
-					lgr.Error(err).Msg("cloning git repo")
-					return
-				}
-				if err := spawn(tmp_dir, nil, "cargo", "--quiet", "vendor"); err != nil {
-					lgr.Error(err).Msg("cargo vendor")
-					return
-				}
-				if err := spawn(
-					tmp_dir,
-					// Fabian Boehm: https://github.com/fish-shell/fish-shell/issues/10935#issuecomment-2558599433
-					[]string{"RUSTFLAGS=-C", "target-feature=+crt-static"},
-					"cargo", "install", "--quiet", "--offline", "--path=.",
+			Name:       "fish",
+			Version:    "4.0.2",
+			Depends_On: []string{"cargo"},
+			// TODO: set Git_Build.Commit to what 4.0.2 resolves to. Until then the build fails and logs the commit.
+			Git_Build: &Git_Build{
+				Repository: "https://github.com/fish-shell/fish-shell/",
+				Tag:        "4.0.2",
+				Vendor:     []string{"cargo", "--quiet", "vendor"},
+				Build: []string{
+					"cargo", "build", "--quiet", "--release", "--offline",
 					// https://users.rust-lang.org/t/the-source-requires-a-lock-file-to-be-present-first-before-it-can-be-used-against-vendored-source-code/122648
 					"--locked",
 					// auto generated by `cargo vendor`
@@ -302,64 +450,64 @@ func main() {
 					"--config", `source."git+https://github.com/fish-shell/rust-pcre2?tag=0.2.9-utf32".tag="0.2.9-utf32"`,
 					"--config", `source."git+https://github.com/fish-shell/rust-pcre2?tag=0.2.9-utf32".replace-with="vendored-sources"`,
 					"--config", `source.vendored-sources.directory="vendor"`,
-				); err != nil {
-					lgr.Error(err).Msg("cargo install")
-					return
-				}
-				lgr.Info().Done("installing fish")
-				return
+				},
+				// Fabian Boehm: https://github.com/fish-shell/fish-shell/issues/10935#issuecomment-2558599433
+				Environment: []string{"RUSTFLAGS=-C target-feature=+crt-static"},
+				Binaries: []string{
+					"target/release/fish",
+					"target/release/fish_indent",
+					"target/release/fish_key_reader",
+				},
+			},
+		},
+		"stylua": {
+			Name:       "stylua",
+			Depends_On: []string{"cargo"},
+			Cargo_Install: &Cargo_Install{
+				Crate:   "stylua",
+				Version: "2.1.0",
+				Locked:  true,
 			},
 		},
 		"nvim": {
-			Name: "nvim",
-			Version: `NVIM v0.11.3
-Build type: Release
-LuaJIT 2.1.1741730670
-Run "nvim -V1 -v" for more info`,
+			Name:                    "nvim",
+			Version:                 "0.11.3",
 			Download_Link:           "https://github.com/neovim/neovim/releases/download/v0.11.3/nvim-macos-arm64.tar.gz",
 			Checksum:                "17d22826f19fe28a11f9ab4bee13c43399fdcce485eabfa2bea6c5b3d660740f",
 			Retain_Installation_Dir: true,
 		},
 		"fzf": {
 			Name:          "fzf",
-			Version:       "0.64.0 (0076ec2e)",
+			Version:       "0.64.0",
 			Download_Link: "https://github.com/junegunn/fzf/releases/download/v0.64.0/fzf-0.64.0-darwin_arm64.tar.gz",
 			Checksum:      "c71d2528e090de5d4765017d745f8a4fed44b43703f93247a28f6dc2aa4c7c01",
 		},
 		"fd": {
 			Name:          "fd",
-			Version:       "fd 10.2.0",
+			Version:       "10.2.0",
 			Download_Link: "https://github.com/sharkdp/fd/releases/download/v10.2.0/fd-v10.2.0-aarch64-apple-darwin.tar.gz",
 			Checksum:      "ae6327ba8c9a487cd63edd8bddd97da0207887a66d61e067dfe80c1430c5ae36", // manually calculated
+			Man_Pages:     []string{"fd.1"},
 		},
 		"rg": {
-			Name: "rg",
-			Version: `ripgrep 14.1.1 (rev 4649aa9700)
-
-features:+pcre2
-simd(compile):+NEON
-simd(runtime):+NEON
-
-PCRE2 10.43 is available (JIT is available)`,
+			Name:          "rg",
+			Version:       "14.1.1",
 			Download_Link: "https://github.com/BurntSushi/ripgrep/releases/download/14.1.1/ripgrep-14.1.1-aarch64-apple-darwin.tar.gz",
 			Checksum:      "24ad76777745fbff131c8fbc466742b011f925bfa4fffa2ded6def23b5b937be",
+			Man_Pages:     []string{"rg.1"},
 		},
 		"lazydocker": {
-			Name: "lazydocker",
-			Version: `Version: 0.24.1
-Date: 2024-11-23T06:32:15Z
-BuildSource: binaryRelease
-Commit: be051153525b018a46f71a2b2ed42cde39a1110c
-OS: darwin
-Arch: arm64`,
+			Name:          "lazydocker",
+			Version:       "0.24.1",
 			Download_Link: "https://github.com/jesseduffield/lazydocker/releases/download/v0.24.1/lazydocker_0.24.1_Darwin_arm64.tar.gz",
 			Checksum:      "55d8ff53d9bd36ee088393154442d3b93db787118be5ad0ae80c200d76311ec2",
 		},
 		"hyperfine": {
 			Name:          "hyperfine",
-			Version:       `hyperfine 1.19.0`,
+			Version:       "1.19.0",
 			Download_Link: "https://github.com/sharkdp/hyperfine/releases/download/v1.19.0/hyperfine-v1.19.0-aarch64-apple-darwin.tar.gz",
 			Checksum:      "502e7c7f99e7e1919321eaa23a4a694c34b1b92d99cbd773a4a2497e100e088f", // manually calculated
+			Man_Pages:     []string{"hyperfine.1"},
 		},
 	}
 
@@ -373,53 +521,304 @@ Arch: arm64`,
 			invariant.Always(is_valid_url(artifact.Download_Link), "Artifact download link is a valid URL")
 			invariant.Always(artifact.Checksum != "", "Direct binary downloads have a sha256 checksum")
 		}
+		for _, page := range artifact.Man_Pages {
+			invariant.Always(artifact.Download_Link != "", "Only direct binary downloads declare man pages")
+			invariant.Always(man_page_pattern.MatchString(page), "Man pages are file names ending in their section")
+		}
+		if artifact.Version_Pattern != "" {
+			_, err := regexp.Compile(artifact.Version_Pattern)
+			invariant.Always(err == nil, "Artifact version pattern is a valid regular expression")
+		}
+		if artifact.Version_Constraint != "" {
+			_, err := parse_version_constraint(artifact.Version_Constraint)
+			invariant.Always(err == nil, "Artifact version constraint is valid")
+		}
+		if artifact.Git_Build != nil {
+			invariant.Always(artifact.Install == nil && artifact.Download_Link == "", "Artifacts have exactly one installation method")
+			invariant.Always(is_valid_url(artifact.Git_Build.Repository), "Git build repository is a valid URL")
+			invariant.Always(artifact.Git_Build.Tag != "", "Git builds are pinned to a tag")
+			invariant.Always(
+				artifact.Git_Build.Commit == "" || regexp.MustCompile(`^[0-9a-f]{40}$`).MatchString(artifact.Git_Build.Commit),
+				"Git build commits are full hashes",
+			)
+			invariant.Always(len(artifact.Git_Build.Build) > 0, "Git builds have a build command")
+			invariant.Always(len(artifact.Git_Build.Binaries) > 0, "Git builds declare their output binaries")
+		}
+		if artifact.Go_Install != nil {
+			invariant.Always(artifact.Install == nil && artifact.Download_Link == "" && artifact.Git_Build == nil, "Artifacts have exactly one installation method")
+			invariant.Always(artifact.Go_Install.Package != "", "Go installs have a package path")
+			invariant.Always(strings.HasPrefix(artifact.Go_Install.Version, "v"), "Go installs are pinned to a module version")
+		}
+		if artifact.Cargo_Install != nil {
+			invariant.Always(
+				artifact.Install == nil && artifact.Download_Link == "" && artifact.Git_Build == nil && artifact.Go_Install == nil,
+				"Artifacts have exactly one installation method",
+			)
+			invariant.Always(artifact.Cargo_Install.Crate != "", "Cargo installs have a crate name")
+			invariant.Always(artifact.Cargo_Install.Version != "", "Cargo installs are pinned to an exact version")
+		}
+		invariant.Always(artifact.Name != filepath.Base(cargo_installs_dir()), "Artifacts don't share BIG_BANG_SHARE with the cargo install roots")
+		for _, dependency := range artifact.Depends_On {
+			_, ok := artifacts[dependency]
+			invariant.Always(ok && dependency != artifact.Name, "Artifacts depend on other artifacts in the manifest")
+		}
 	}
+	invariant.Always(len(install_order(artifacts)) == len(artifacts), "Artifact dependencies have no cycles")
 
-	// === Filter artifacts to install ===
-	default_healthcheck_step := func(artifact *Artifact) error {
-		path := which(artifact.Name)
+	// === Set health checks ===
+	for name, artifact := range artifacts {
+		if artifact.Checkhealth == nil {
+			if artifact.Go_Install != nil {
+				artifact.Checkhealth = func(ctx context.Context) error {
+					return go_install_healthcheck(ctx, &artifact)
+				}
+			} else if artifact.Cargo_Install != nil {
+				artifact.Checkhealth = func(ctx context.Context) error {
+					return cargo_install_healthcheck(ctx, &artifact)
+				}
+			} else {
+				artifact.Checkhealth = func(ctx context.Context) error {
+					return default_healthcheck(ctx, &artifact)
+				}
+			}
+			artifacts[name] = artifact
+		}
+	}
+	return artifacts
+}
+
+// Health checks for artifacts that don't bring their own. The binaries have to resolve inside BIG_BANG_DATA_DIR.
+func default_healthcheck(ctx context.Context, artifact *Artifact) error {
+	path := which(artifact.Name)
+	if path == "" {
+		return fmt.Errorf("%s is not installed", artifact.Name)
+	} else if !strings.HasPrefix(path, BIG_BANG_DATA_DIR) {
+		return not_managed_error(artifact.Name, path)
+	}
+
+	command := artifact.version_command()
+	output := pipe_context(ctx, command[0], command[1:]...)
+	return artifact.check_version(output)
+}
+
+func go_install_healthcheck(ctx context.Context, artifact *Artifact) error {
+	path := which(artifact.Name)
+	if path == "" {
+		return fmt.Errorf("%s is not installed", artifact.Name)
+	} else if !strings.HasPrefix(path, BIG_BANG_DATA_DIR) {
+		return not_managed_error(artifact.Name, path)
+	}
+	return artifact.Go_Install.matches_build_info(ctx, path)
+}
+
+func cargo_install_healthcheck(ctx context.Context, artifact *Artifact) error {
+	for _, binary := range artifact.Cargo_Install.binaries(artifact.Name) {
+		path := which(binary)
 		if path == "" {
-			return fmt.Errorf("%s is not installed", artifact.Name)
+			return fmt.Errorf("%s is not installed", binary)
 		} else if !strings.HasPrefix(path, BIG_BANG_DATA_DIR) {
-			return fmt.Errorf("%s installation is not inside BIG_BANG_DATA_DIR", artifact.Name)
+			return not_managed_error(binary, path)
 		}
+	}
+	return artifact.Cargo_Install.matches_install_list(ctx, cargo_install_root(artifact.Name))
+}
 
-		expect := artifact.Version
-		actual := pipe(artifact.Name, "--version")
-		if actual == expect {
-			return nil
+// Runs the install, sync, and system preferences phases. An empty command runs all of them.
+func command_run(state *State, lgr *itlog.Logger, command string, arguments []string) (exit_code int) {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	output := flags.String("output", "text", "text or json")
+	trace_path := flags.String("trace", "", "write a Chrome trace-event file")
+	yes := flags.Bool("yes", false, "delete dotfiles removed from the repo without asking")
+	show_diff := flags.Bool("diff", false, "print the diff of every dotfile before syncing")
+	conflict := flags.String("conflict", conflict_ask, "ask, merge, mine, or theirs")
+	list := flags.Bool("list", false, "print the dotfiles a sync considers without syncing")
+	positional, err := parse_flags(flags, arguments)
+	valid_conflict := slices.Contains([]string{conflict_ask, conflict_merge, conflict_mine, conflict_theirs}, *conflict)
+	if err != nil || len(positional) != 0 || (*output != "text" && *output != "json") || !valid_conflict || (*list && command != "sync") {
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+	if *list {
+		return command_sync_list(lgr, *output)
+	}
+	if *trace_path != "" && !filepath.IsAbs(*trace_path) {
+		*trace_path = filepath.Join(invocation_dir, *trace_path)
+	}
+	tracer = &Tracer{start: time.Now()}
+	defer func() { tracer = nil }()
+	console := io.Writer(os.Stdout)
+	console_level := console_log_level
+	if *output == "json" {
+		// Stdout is reserved for the event stream.
+		console = os.Stderr
+		events = &Event_Stream{writer: os.Stdout}
+		defer func() { events = nil }()
+	} else if is_terminal(os.Stdout) && (command == "" || command == "install") {
+		// The progress view already shows what each artifact is doing so only problems are printed above it.
+		progress = start_progress(os.Stdout)
+		console = progress
+		console_level = max(console_level, itlog.LevelWarn)
+	}
+	report := &Run_Report{}
+	run_log, err = open_run_log(cmp.Or(command, "run"))
+	if err != nil {
+		// Losing the history of a run isn't worth refusing to run.
+		itlog.New(console, console_level).Warn().Err(err).Msg("opening run log")
+	}
+	lgr = new_run_logger(console, console_level, run_log)
+	defer func() {
+		run_log.finish(report, exit_code)
+		run_log = nil
+	}()
+	defer func() {
+		progress.stop()
+		progress = nil
+		exit_code = report.exit_code(exit_code)
+		if *trace_path != "" {
+			if err := tracer.write_chrome_trace(*trace_path); err != nil {
+				lgr.Error(err).Str("file", *trace_path).Msg("writing trace")
+				exit_code = exit_failure
+			}
+		}
+		if *output == "json" {
+			events.emit(Event{Type: "run_done", Exit_Code: &exit_code, Outcomes: report.counts()})
 		} else {
-			return fmt.Errorf("%s is wrong version. expected %q. got %q", artifact.Name, expect, actual)
+			report.print(os.Stdout)
+			fmt.Println()
+			tracer.print_breakdown(os.Stdout)
 		}
+	}()
+	phase := func(name string, run func()) {
+		start := time.Now()
+		events.emit(Event{Type: "phase_begin", Phase: name})
+		end := tracer.span(name, "")
+		run()
+		end()
+		events.emit(Event{Type: "phase_done", Phase: name, Duration_Ms: time.Since(start).Milliseconds()})
 	}
-	for name, artifact := range artifacts {
-		if artifact.Checkhealth == nil {
-			artifact.Checkhealth = func() error {
-				return default_healthcheck_step(&artifact)
-			}
-			artifacts[name] = artifact
+	if command == "" || command == "install" {
+		phase("install", func() { install_artifacts(state, report, lgr) })
+		// The view only tracks artifacts and would tear the prompts that syncing may show.
+		progress.stop()
+		progress = nil
+	}
+	if command == "" || command == "sync" {
+		options := Sync_Options{
+			Yes:         *yes,
+			Diff:        *show_diff,
+			Conflict:    *conflict,
+			Interactive: *output == "text" && is_terminal(os.Stdin),
+			Run_Id:      time.Now().UTC().Format(run_log_time_format),
 		}
-		reason := artifact.Checkhealth()
-		if reason == nil {
+		if run_log != nil {
+			options.Run_Id = run_log.id
+		}
+		phase("sync", func() { sync_dotfiles(state, report, lgr, options) })
+	}
+	if command == "" {
+		phase("system_preferences", func() { setup_system_preferences(report, lgr) })
+	}
+	return exit_ok
+}
+
+func install_artifacts(state *State, report *Run_Report, lgr *itlog.Logger) {
+	artifacts := artifact_manifest()
+
+	// === Filter artifacts to install ===
+	health := &Health_Cache{}
+	health.probe(artifacts, lgr)
+	for name := range artifacts {
+		if health.get(name) == nil {
+			report.add(Report_Entry{Kind: "artifact", Name: name, Outcome: outcome_unchanged})
 			delete(artifacts, name)
-			continue
 		}
 	}
 
 	// === Installation ===
+	type Attempt struct {
+		reason      error
+		was_present bool
+		ok          bool
+		// The dependency whose failure kept this artifact from being attempted.
+		blocked_by string
+		duration   time.Duration
+	}
+	var attempts_mutex sync.Mutex
+	attempts := make(map[string]Attempt, len(artifacts))
+	// Closed once an artifact's attempt is recorded so the artifacts that depend on it can go ahead.
+	attempted := make(map[string]chan struct{}, len(artifacts))
+	for name := range artifacts {
+		attempted[name] = make(chan struct{})
+	}
 	func() {
 		total_ctx, total_cancel := context.WithTimeout(context.Background(), time.Minute*5)
 		defer total_cancel()
 		var wg sync.WaitGroup
 		defer wg.Wait()
-		for _, artifact := range artifacts {
+		for _, artifact := range install_order(artifacts) {
 			invariant.Always(artifact.Checkhealth != nil, "All artifacts had their Checkhealth function set")
-			reason := artifact.Checkhealth()
+			reason := health.get(artifact.Name)
 			invariant.Always(reason != nil, "All remaining artifacts failed initial health check")
+			health.forget(artifact.Name)
+			_, was_recorded := state.Artifacts[artifact.Name]
+			was_present := was_recorded || slices.ContainsFunc(artifact.executables(), func(executable string) bool {
+				return which(executable) != ""
+			})
+			start := time.Now()
 
 			lgr := lgr.Clone().WithErr("installation_reason", reason)
+			record := func(installed []string, ok bool) {
+				if ok {
+					if err := state.record_artifact(artifact, installed); err != nil {
+						lgr.Error(err).Str("artifact", artifact.Name).Msg("recording installed files")
+					}
+				}
+				attempts_mutex.Lock()
+				defer attempts_mutex.Unlock()
+				attempts[artifact.Name] = Attempt{reason: reason, was_present: was_present, ok: ok, duration: time.Since(start)}
+				close(attempted[artifact.Name])
+			}
+			// Dependencies come first in install_order but downloads may still be in flight.
+			blocked_by := ""
+			for _, dependency := range artifact.Depends_On {
+				channel, ok := attempted[dependency]
+				if !ok {
+					// Healthy, so it wasn't installed this run.
+					continue
+				}
+				<-channel
+				attempts_mutex.Lock()
+				dependency_ok := attempts[dependency].ok
+				attempts_mutex.Unlock()
+				if !dependency_ok {
+					blocked_by = dependency
+					break
+				}
+			}
+			if blocked_by != "" {
+				lgr.Error().Str("artifact", artifact.Name).Str("dependency", blocked_by).Msg("skipping artifact whose dependency failed")
+				attempts_mutex.Lock()
+				attempts[artifact.Name] = Attempt{reason: reason, was_present: was_present, blocked_by: blocked_by}
+				close(attempted[artifact.Name])
+				attempts_mutex.Unlock()
+				continue
+			}
 			if artifact.Install != nil {
-				artifact.Install(lgr)
+				// Custom installers don't report what they put on the machine so they aren't recorded. Whether they
+				// succeeded is left to the health check.
+				end := tracer.span("custom installing", artifact.Name)
+				artifact.Install(lgr, run_log.child_output(artifact.Name))
+				end()
+				attempts_mutex.Lock()
+				attempts[artifact.Name] = Attempt{reason: reason, was_present: was_present, ok: true, duration: time.Since(start)}
+				close(attempted[artifact.Name])
+				attempts_mutex.Unlock()
+			} else if artifact.Git_Build != nil {
+				record(install_git_build(artifact, lgr))
+			} else if artifact.Go_Install != nil {
+				record(install_go_install(artifact, lgr))
+			} else if artifact.Cargo_Install != nil {
+				record(install_cargo_install(artifact, lgr))
 			} else {
 				invariant.Always(artifact.Download_Link != "", "Artifacts without a custom install step are direct binary downloads")
 				wg.Add(1)
@@ -427,67 +826,372 @@ Arch: arm64`,
 					defer wg.Done()
 					individual_ctx, individual_cancel := context.WithTimeout(total_ctx, time.Minute*3)
 					defer individual_cancel()
-					download_path := download_artifact(individual_ctx, artifact, BIG_BANG_TMP, lgr)
+					// Each download gets its own directory since retained installations move the whole directory.
+					download_path := download_artifact(individual_ctx, artifact, filepath.Join(BIG_BANG_TMP, artifact.Name), lgr)
 					if download_path == "" {
+						record(nil, false)
 						return
 					}
-					install_artifact(artifact, download_path, lgr)
+					installed, ok := install_artifact(artifact, download_path, lgr)
+					if ok {
+						if err := prune_download_cache(artifact); err != nil {
+							lgr.Warn().Err(err).Str("artifact", artifact.Name).Msg("pruning download cache")
+						}
+					}
+					record(installed, ok)
 				}()
 			}
 		}
 	}()
+	if err := state.save(); err != nil {
+		lgr.Error(err).Str("file", state_file_path()).Msg("saving installed state")
+		report.add(Report_Entry{Kind: "step", Name: "state file", Outcome: outcome_failed, Reason: err.Error()})
+	}
+
+	health.probe(artifacts, lgr)
+	for name := range artifacts {
+		attempt, ok := attempts[name]
+		invariant.Always(ok, "Every artifact that failed its health check had an installation attempt")
+		entry := Report_Entry{Kind: "artifact", Name: name, Duration: attempt.duration}
+		switch reason := health.get(name); {
+		case attempt.blocked_by != "":
+			entry.Outcome = outcome_skipped
+			entry.Reason = attempt.blocked_by + " failed to install"
+		case !attempt.ok:
+			entry.Outcome = outcome_failed
+			entry.Reason = "installation failed, see the log above"
+		case reason != nil:
+			entry.Outcome = outcome_failed
+			entry.Reason = "still unhealthy after installation: " + reason.Error()
+		case attempt.was_present:
+			entry.Outcome = outcome_upgraded
+			entry.Reason = attempt.reason.Error()
+		default:
+			entry.Outcome = outcome_installed
+			entry.Reason = attempt.reason.Error()
+		}
+		report.add(entry)
+	}
+}
 
-	invariant.Always(func() bool {
-		for _, artifact := range artifacts {
-			if artifact.Checkhealth() != nil {
+// Every artifact comes after the ones it depends on. Artifacts that aren't in the map are taken as installed already.
+// Otherwise the order is by name. Artifacts in a dependency cycle are left out.
+func install_order(artifacts map[string]Artifact) (ordered []Artifact) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[string]int, len(artifacts))
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		artifact, ok := artifacts[name]
+		if !ok {
+			return true
+		}
+		switch marks[name] {
+		case visiting:
+			return false
+		case visited:
+			return true
+		}
+		marks[name] = visiting
+		for _, dependency := range artifact.Depends_On {
+			if !visit(dependency) {
 				return false
 			}
 		}
+		marks[name] = visited
+		ordered = append(ordered, artifact)
 		return true
-	}(), "All artifacts pass health check")
+	}
+	for _, name := range slices.Sorted(maps.Keys(artifacts)) {
+		visit(name)
+	}
+	return ordered
+}
+
+type Sync_Options struct {
+	// Delete managed dotfiles that were removed from the repo without asking.
+	Yes bool
+	// Print the diff of the dotfiles about to be written. When interactive, the sync only goes ahead once confirmed.
+	Diff bool
+	// Whether the user can be asked for confirmation.
+	Interactive bool
+	// Files that are overwritten or deleted are backed up under this id. See backup_dotfile.
+	Run_Id string
+	// What to do with dotfiles edited both locally and in the repo. One of the conflict_* constants.
+	Conflict string
+}
 
+func sync_dotfiles(state *State, report *Run_Report, lgr *itlog.Logger, options Sync_Options) {
 	// === Sync dotfiles ===
+	files, matched, ok := mismatched_dotfiles(lgr)
+	if !ok {
+		report.add(Report_Entry{Kind: "dotfile", Name: "dotfiles", Outcome: outcome_failed, Reason: "collecting dotfiles failed, see the log above"})
+		return
+	}
+	failed := false
 	func() {
-		files := mismatched_dotfiles(lgr)
+		for expect, actual := range matched {
+			report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome_unchanged})
+			strategy, err := dotfile_strategy(expect, actual)
+			// Files that were already in place are managed all the same.
+			switch {
+			case err != nil:
+				lgr.Warn().Err(err).Str("file", actual).Msg("recording matched dotfile")
+			case strategy == strategy_symlink:
+				state.record_dotfile_symlink(expect, actual)
+			case strategy == strategy_seed_once:
+				state.forget_dotfile(actual)
+			default:
+				if err := state.track_dotfile(expect, actual); err != nil {
+					lgr.Warn().Err(err).Str("file", actual).Msg("recording matched dotfile")
+				}
+			}
+		}
 		if len(files) == 0 {
 			return
 		}
+		if options.Diff {
+			// With --output=json stdout belongs to the event stream.
+			writer := io.Writer(os.Stdout)
+			if events != nil {
+				writer = os.Stderr
+			}
+			// Only what is about to be written is diffed. The rest is listed with the reason it's left alone.
+			to_write := make(map[string]string, len(files))
+			left_alone := make(map[string]string)
+			for expect, actual := range files {
+				if reason := dotfile_skip_reason(state, expect, actual, options); reason != "" {
+					left_alone[actual] = reason
+				} else {
+					to_write[expect] = actual
+				}
+			}
+			write_dotfile_diffs(writer, to_write, lgr)
+			if len(left_alone) > 0 {
+				fmt.Fprintf(writer, "\n%d dotfiles won't be written:\n", len(left_alone))
+				for _, actual := range slices.Sorted(maps.Keys(left_alone)) {
+					fmt.Fprintf(writer, "  %s: %s\n", display_home_path(actual), left_alone[actual])
+				}
+			}
+			if options.Interactive && len(to_write) > 0 && !confirm(fmt.Sprintf("write %d dotfiles?", len(to_write))) {
+				for _, actual := range to_write {
+					report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome_skipped, Reason: "declined after reviewing the diff"})
+				}
+				for actual, reason := range left_alone {
+					report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome_skipped, Reason: reason})
+				}
+				failed = true
+				return
+			}
+		}
 		lgr.Info().Begin("syncing dotfiles")
+		defer tracer.span("syncing dotfiles", "")()
+		var failure error
 		for expect, actual := range files {
+			if failure != nil {
+				report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome_skipped, Reason: "an earlier dotfile failed to sync"})
+				continue
+			}
 			invariant.Always(filepath.IsAbs(expect), "Expected dotfile path is absolute")
 			invariant.Always(filepath.IsAbs(actual), "Actual dotfile path is absolute")
 			invariant.Always(!strings.HasPrefix(actual, BIG_BANG_GIT_DIR), "Actual dotfile is outside big bang git dir")
 			invariant.Always(strings.HasPrefix(expect, big_bang_dotfiles_root), "Expected dotfile is inside big bang dotfiles")
 			invariant.Always(!is_dir(actual), "Actual dotfile is not a directory")
 
+			start := time.Now()
+			outcome := outcome_upgraded
+			if !file_exists(actual) {
+				outcome = outcome_installed
+			}
+			reason := "differs from " + expect
+			class, err := classify_dotfile(state, expect, actual)
+			if err != nil {
+				lgr.Error(err).Str("file", actual).Msg("classifying dotfile")
+				report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome_failed, Reason: err.Error()})
+				failure = err
+				continue
+			}
+			// Written to HOME. The repo file unless the user asked for a merge.
+			var merged []byte
+			switch class {
+			case dotfile_home_changed:
+				report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome_skipped, Reason: skip_reason_home_changed})
+				continue
+			case dotfile_conflict:
+				resolution := options.Conflict
+				if resolution == conflict_ask {
+					resolution = conflict_skip
+					if options.Interactive {
+						resolution = ask_conflict_resolution(expect, actual)
+					}
+				}
+				switch resolution {
+				case conflict_skip:
+					report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome_skipped, Reason: skip_reason_conflict})
+					continue
+				case conflict_mine:
+					// Recording the repo file as written makes later runs treat the file as a local edit instead of
+					// asking again.
+					contents, err := read_dotfile_source(expect)
+					if err == nil {
+						err = state.record_dotfile(expect, actual, contents)
+					}
+					if err != nil {
+						lgr.Error(err).Str("file", actual).Msg("keeping local dotfile")
+						report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome_failed, Reason: err.Error()})
+						failure = err
+						continue
+					}
+					report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome_skipped, Reason: skip_reason_kept_mine})
+					continue
+				case conflict_merge:
+					var conflicts int
+					merged, conflicts, err = merge_dotfile(state, expect, actual)
+					if err != nil {
+						lgr.Error(err).Str("file", actual).Msg("merging dotfile")
+						report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome_failed, Reason: err.Error()})
+						failure = err
+						continue
+					}
+					reason = "merged with " + expect
+					if conflicts > 0 {
+						reason = fmt.Sprintf("merged with %s. resolve %d conflicts marked with <<<<<<<", expect, conflicts)
+					}
+				case conflict_theirs:
+				default:
+					invariant.Unreachable("Conflict resolutions are validated when parsing flags")
+				}
+			}
 			err_sync := func() error {
-				contents, err := os.ReadFile(expect)
+				strategy, err := dotfile_strategy(expect, actual)
 				if err != nil {
 					return err
 				}
-				if err := os.MkdirAll(filepath.Dir(actual), 0o755); err != nil {
+				if err := make_dotfile_dirs(filepath.Dir(actual)); err != nil {
 					return err
 				}
-				if err := os.WriteFile(actual, contents, 0o644); err != nil {
+				if err := backup_dotfile(options.Run_Id, actual, strings.HasSuffix(expect, encrypted_suffix)); err != nil {
+					return fmt.Errorf("backing up: %w", err)
+				}
+				// Writing through a symlink would change whatever it points to, so it's replaced instead.
+				if info, err := os.Lstat(actual); err == nil && (strategy == strategy_symlink || info.Mode()&fs.ModeSymlink != 0) {
+					if err := os.Remove(actual); err != nil {
+						return err
+					}
+				}
+				if strategy == strategy_symlink {
+					if err := os.Symlink(expect, actual); err != nil {
+						return err
+					}
+					state.record_dotfile_symlink(expect, actual)
+					events.emit(Event{Type: "dotfile_write", Path: actual, Source: expect})
+					lgr.Info().Str("file", strings.TrimPrefix(expect, big_bang_dotfiles_root)).Msg("linked dotfile")
+					return nil
+				}
+
+				contents, err := read_dotfile_source(expect)
+				if err != nil {
+					return err
+				}
+				written := contents
+				if merged != nil {
+					written = merged
+				}
+				mode, err := dotfile_mode(expect, actual)
+				if err != nil {
+					return err
+				}
+				// Existing files keep their mode through os.WriteFile, so it's changed before secrets are written into
+				// them and the umask can't narrow new files.
+				if err := os.Chmod(actual, mode); err != nil && !errors.Is(err, fs.ErrNotExist) {
 					return err
 				}
+				if err := os.WriteFile(actual, written, mode); err != nil {
+					return err
+				}
+				if err := os.Chmod(actual, mode); err != nil {
+					return err
+				}
+				if strategy == strategy_seed_once {
+					// Seeded files belong to the program that uses them from here on. Without a record they're never
+					// classified, merged, or deleted.
+					state.forget_dotfile(actual)
+				} else if err := state.record_dotfile(expect, actual, contents); err != nil {
+					// A merge records the repo file so the merged result counts as a local edit from here on.
+					return fmt.Errorf("recording: %w", err)
+				}
+				event := Event{Type: "dotfile_write", Path: actual, Source: expect, Bytes: int64(len(written))}
+				// Even a hash of a secret can give it away if it's short.
+				if !strings.HasSuffix(expect, encrypted_suffix) {
+					checksum := sha256.Sum256(written)
+					event.Sha256 = hex.EncodeToString(checksum[:])
+				}
+				events.emit(event)
 				lgr.Info().Str("file", strings.TrimPrefix(expect, big_bang_dotfiles_root)).Msg("updated dotfile")
 				return nil
 			}()
 			if err_sync != nil {
 				lgr.Error(err_sync).Msg("syncing dotfiles")
-				return
+				report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome_failed, Reason: err_sync.Error(), Duration: time.Since(start)})
+				failure = err_sync
+				continue
 			}
+			report.add(Report_Entry{Kind: "dotfile", Name: actual, Outcome: outcome, Reason: reason, Duration: time.Since(start)})
+		}
+		if failure == nil {
+			lgr.Info().Done("syncing dotfiles")
+		} else {
+			failed = true
 		}
-		lgr.Info().Done("syncing dotfiles")
 	}()
 
+	// === Remove dotfiles deleted from the repo ===
+	// Skipped after a failure or a declined sync since a half-synced tree is a bad time to delete things.
+	if !failed {
+		remove_stale_dotfiles(state, report, lgr, options)
+	}
+	if err := state.save(); err != nil {
+		lgr.Error(err).Str("file", state_file_path()).Msg("saving installed state")
+		report.add(Report_Entry{Kind: "step", Name: "state file", Outcome: outcome_failed, Reason: err.Error()})
+	} else if err := prune_dotfile_bases(state); err != nil {
+		lgr.Warn().Err(err).Msg("pruning merge bases")
+	}
+}
+
+const (
+	skip_reason_home_changed = "edited locally since big_bang wrote it. see the diff command, or move it aside to take the repo's"
+	skip_reason_conflict     = "edited locally and in the repo. rerun with --conflict=merge, mine, or theirs"
+	skip_reason_kept_mine    = "conflict resolved by keeping the local file"
+)
+
+// Why a sync will leave a mismatched dotfile alone, or "" if it's going to be written. Conflicts that will be asked about
+// count as written since the answer isn't known yet. Classification errors do as well, the sync reports them.
+func dotfile_skip_reason(state *State, expect, actual string, options Sync_Options) string {
+	class, err := classify_dotfile(state, expect, actual)
+	switch {
+	case err != nil:
+		return ""
+	case class == dotfile_home_changed:
+		return skip_reason_home_changed
+	case class == dotfile_conflict && options.Conflict == conflict_mine:
+		return skip_reason_kept_mine
+	case class == dotfile_conflict && options.Conflict == conflict_ask && !options.Interactive:
+		return skip_reason_conflict
+	}
+	return ""
+}
+
+func setup_system_preferences(report *Run_Report, lgr *itlog.Logger) {
 	// === Setup system preferences (darwin) ===
 	func() {
 		if runtime.GOOS != "darwin" {
 			return
 		}
 		lgr.Info().Begin("system preferences setup")
+		start := time.Now()
 		config := `
 	  defaults write com.apple.dock autohide               -bool   true
           defaults write com.apple.dock autohide-delay         -float  0
@@ -542,98 +1246,3562 @@ Arch: arm64`,
 				continue
 			}
 			args := strings.Fields(line)
-			if err := spawn("", nil, args[0], args[1:]...); err != nil {
+			if err := spawn(nil, "", nil, args[0], args[1:]...); err != nil {
 				lgr.Error().Msg("system preferences setup")
+				report.add(Report_Entry{Kind: "step", Name: "system preferences", Outcome: outcome_failed, Reason: strings.TrimSpace(line), Duration: time.Since(start)})
 				return
 			}
 		}
-		if err := spawn("", nil, `defaults`, `write`, `com.apple.menuextra.clock`, `DateFormat`, `-string`, `EEE MMM d mm:HH`); err != nil {
+		if err := spawn(nil, "", nil, `defaults`, `write`, `com.apple.menuextra.clock`, `DateFormat`, `-string`, `EEE MMM d mm:HH`); err != nil {
 			lgr.Error().Msg("system preferences setup (date format)")
+			report.add(Report_Entry{Kind: "step", Name: "system preferences", Outcome: outcome_failed, Reason: "date format", Duration: time.Since(start)})
 			return
 		}
+		report.add(Report_Entry{Kind: "step", Name: "system preferences", Outcome: outcome_installed, Duration: time.Since(start)})
 		lgr.Info().Done("system preferences setup")
 	}()
 }
 
-// Map key = repo file; value = corresponding file in HOME.
-func mismatched_dotfiles(lgr *itlog.Logger) (mismatched_files map[string]string) {
-	invariant.Always(filepath.IsAbs(big_bang_dotfiles_root), "dotfiles path is absolute")
-	invariant.Always(dir_exists(big_bang_dotfiles_root), "dotfiles directory exists already")
-	defer func() {
-		if len(mismatched_files) > 0 {
-			invariant.Always(func() bool {
-				for file := range mismatched_files {
-					if !filepath.IsAbs(file) {
-						return false
-					}
-				}
-				return true
-			}(), "file path is absolute")
-		}
-	}()
-
-	filepath_relative_child := func(base, target string) string {
-		base = filepath.Clean(base)
-		target = filepath.Clean(target)
+const (
+	// Still has the contents big_bang wrote.
+	stale_unchanged = "unchanged"
+	stale_modified  = "modified"
+	// Already gone from HOME. Only its record is left.
+	stale_missing = "missing"
+)
 
-		invariant.Always(filepath.IsAbs(target), "Target is an absolute file path")
-		invariant.Always(filepath.IsAbs(base), "Base directory is an absolute file path")
-		invariant.Always(strings.HasPrefix(target, base), "Target is a child of base directory")
+type Stale_Dotfile struct {
+	Kind string
+	// The destination in HOME.
+	Path   string
+	Record Dotfile_Record
+}
 
-		rel, err := filepath.Rel(base, target)
-		if err != nil {
-			invariant.Unreachable("Computing the relative path of target from base is successful")
+// Recorded dotfiles that no layer in the repo provides anymore. Layers that don't apply to this machine count too, so a
+// profile dropped from BIG_BANG_PROFILES or another machine's hosts/ layer never gets its files deleted.
+func stale_dotfiles(state *State) (stale []Stale_Dotfile, err error) {
+	layers, err := repo_dotfile_layers()
+	if err != nil {
+		return nil, err
+	}
+	destinations, err := collect_dotfiles(layers)
+	if err != nil {
+		return nil, err
+	}
+	state.mutex.Lock()
+	records := maps.Clone(state.Dotfiles)
+	state.mutex.Unlock()
+	for _, destination := range slices.Sorted(maps.Keys(records)) {
+		if _, ok := destinations[destination]; ok {
+			continue
+		}
+		record := records[destination]
+		entry := Stale_Dotfile{Kind: stale_unchanged, Path: destination, Record: record}
+		unchanged, err := dotfile_is_as_written(destination, record)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			entry.Kind = stale_missing
+		case err != nil || !unchanged:
+			// Can't prove it's unchanged so it's treated as if it was edited.
+			entry.Kind = stale_modified
 		}
-		return rel
+		stale = append(stale, entry)
 	}
+	return stale, nil
+}
 
-	swap_old_to_new_base_directory := func(old_target, old_base, new_base string) (new_target string) {
-		invariant.Always(filepath.IsAbs(new_base), "")
-		new_base = filepath.Clean(new_base)
-		target_relative_to_old_base := filepath_relative_child(old_base, old_target)
-		return filepath.Join(new_base, target_relative_to_old_base)
+// For records without a hash of what was written. The record is made after the file is written so any later write
+// moves the modification time past it.
+func dotfile_modified_since_written(destination string, record Dotfile_Record) (modified bool, err error) {
+	info, err := os.Stat(destination)
+	if err != nil {
+		return false, err
+	}
+	return info.ModTime().After(record.Written_At), nil
+}
+
+// Whether a dotfile in HOME is still what big_bang wrote. A symlink only has to point where it used to.
+func dotfile_is_as_written(destination string, record Dotfile_Record) (unchanged bool, err error) {
+	if record.Symlink != "" {
+		if _, err := os.Lstat(destination); err != nil {
+			return false, err
+		}
+		target, err := os.Readlink(destination)
+		return err == nil && target == record.Symlink, nil
+	}
+	if strings.HasSuffix(record.Source, encrypted_suffix) {
+		modified, err := dotfile_modified_since_written(destination, record)
+		return !modified, err
+	}
+	contents, err := os.ReadFile(destination)
+	if err != nil {
+		return false, err
+	}
+	checksum := sha256.Sum256(contents)
+	return hex.EncodeToString(checksum[:]) == record.Sha256, nil
+}
+
+// Deletes the dotfiles that were removed from the repo, as long as nobody edited them since big_bang wrote them.
+// Edited ones are reported and left in place.
+func remove_stale_dotfiles(state *State, report *Run_Report, lgr *itlog.Logger, options Sync_Options) {
+	stale_files, err := stale_dotfiles(state)
+	if err != nil {
+		lgr.Error(err).Msg("finding dotfiles removed from the repo")
+		report.add(Report_Entry{Kind: "step", Name: "stale dotfiles", Outcome: outcome_failed, Reason: err.Error()})
+		return
+	}
+	var removable []Stale_Dotfile
+	for _, stale := range stale_files {
+		switch stale.Kind {
+		case stale_missing:
+			state.forget_dotfile(stale.Path)
+		case stale_modified:
+			report.add(Report_Entry{
+				Kind:    "dotfile",
+				Name:    stale.Path,
+				Outcome: outcome_skipped,
+				Reason:  "removed from the repo but edited locally. delete it yourself if it's no longer needed",
+			})
+		case stale_unchanged:
+			removable = append(removable, stale)
+		}
+	}
+	if len(removable) == 0 {
+		return
+	}
+	if !options.Yes {
+		approved := false
+		if options.Interactive {
+			fmt.Println("these dotfiles were removed from the repo:")
+			for _, stale := range removable {
+				fmt.Println("  " + stale.Path)
+			}
+			approved = confirm(fmt.Sprintf("delete %d dotfiles?", len(removable)))
+		}
+		if !approved {
+			for _, stale := range removable {
+				report.add(Report_Entry{Kind: "dotfile", Name: stale.Path, Outcome: outcome_skipped, Reason: "removed from the repo. rerun with --yes to delete it"})
+			}
+			return
+		}
+	}
+	for _, stale := range removable {
+		err := func() error {
+			// The file could have been edited while the prompt was up.
+			unchanged, err := dotfile_is_as_written(stale.Path, stale.Record)
+			if err != nil {
+				return err
+			}
+			if !unchanged {
+				return errors.New("edited since it was checked")
+			}
+			if err := backup_dotfile(options.Run_Id, stale.Path, strings.HasSuffix(stale.Record.Source, encrypted_suffix)); err != nil {
+				return fmt.Errorf("backing up: %w", err)
+			}
+			if err := os.Remove(stale.Path); err != nil {
+				return err
+			}
+			// Empty directories left behind are removed as well, e.g. ~/.config/<program>.
+			for directory := filepath.Dir(stale.Path); path_is_within(HOME, directory) && directory != HOME; directory = filepath.Dir(directory) {
+				if os.Remove(directory) != nil {
+					break
+				}
+			}
+			return nil
+		}()
+		if err != nil {
+			lgr.Error(err).Str("file", stale.Path).Msg("removing dotfile deleted from the repo")
+			report.add(Report_Entry{Kind: "dotfile", Name: stale.Path, Outcome: outcome_failed, Reason: err.Error()})
+			continue
+		}
+		state.forget_dotfile(stale.Path)
+		lgr.Info().Str("file", stale.Path).Msg("removed dotfile deleted from the repo")
+		report.add(Report_Entry{Kind: "dotfile", Name: stale.Path, Outcome: outcome_removed, Reason: "removed from the repo"})
+	}
+}
+
+// === Diff ===
+
+const diff_context_lines = 3
+
+type Diff_Op struct {
+	// One of ' ', '-', or '+'.
+	Kind byte
+	Line string
+}
+
+// Myers' O(ND) algorithm. http://www.xmailserver.org/diff2.pdf
+func diff_lines(a, b []string) (ops []Diff_Op) {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+search:
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, slices.Clone(v))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var previous_k int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			previous_k = k + 1
+		} else {
+			previous_k = k - 1
+		}
+		previous_x := v[offset+previous_k]
+		previous_y := previous_x - previous_k
+		for x > previous_x && y > previous_y && x > 0 && y > 0 {
+			ops = append(ops, Diff_Op{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d == 0 {
+			break
+		}
+		if x == previous_x {
+			ops = append(ops, Diff_Op{'+', b[y-1]})
+		} else {
+			ops = append(ops, Diff_Op{'-', a[x-1]})
+		}
+		x, y = previous_x, previous_y
+	}
+	invariant.Always(x == 0 && y == 0, "Backtracking reaches the start of both files")
+	slices.Reverse(ops)
+	return ops
+}
+
+func split_lines(contents []byte) (lines []string) {
+	for line := range strings.Lines(string(contents)) {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+type Diff_Colors struct {
+	header, hunk, removed, added, reset string
+}
+
+func diff_colors(enabled bool) Diff_Colors {
+	if !enabled {
+		return Diff_Colors{}
+	}
+	return Diff_Colors{header: "\x1b[1m", hunk: "\x1b[36m", removed: "\x1b[31m", added: "\x1b[32m", reset: "\x1b[0m"}
+}
+
+// Shortens a path in HOME to ~/<path>.
+func display_home_path(path string) string {
+	if !path_is_within(HOME, path) {
+		return path
+	}
+	return "~/" + strings.TrimPrefix(strings.TrimPrefix(path, HOME), string(filepath.Separator))
+}
+
+// Whether stdout should be coloured. https://no-color.org
+func use_color() bool {
+	return is_terminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+}
+
+// Writes a unified diff that turns the file in HOME (actual) into the repo file (expect), which is what a sync does.
+// A missing actual file is shown as a new file.
+func write_dotfile_diff(writer io.Writer, expect, actual string, colors Diff_Colors) (added, removed int, err error) {
+	expect_contents, err := read_dotfile_source(expect)
+	if err != nil {
+		return 0, 0, err
+	}
+	var actual_contents []byte
+	actual_info, err := os.Stat(actual)
+	is_new := errors.Is(err, fs.ErrNotExist)
+	if err != nil && !is_new {
+		return 0, 0, err
+	}
+	if !is_new {
+		if actual_contents, err = os.ReadFile(actual); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	display_actual := display_home_path(actual)
+	display_expect := strings.TrimPrefix(strings.TrimPrefix(expect, BIG_BANG_GIT_DIR), string(filepath.Separator))
+	fmt.Fprintf(writer, "%sdiff %s %s%s\n", colors.header, display_actual, display_expect, colors.reset)
+	if strategy, err := dotfile_strategy(expect, actual); err != nil {
+		return 0, 0, err
+	} else if strategy == strategy_symlink {
+		fmt.Fprintf(writer, "%s is replaced by a symlink to %s\n", display_actual, display_expect)
+		return 0, 0, nil
+	}
+	mode, err := dotfile_mode(expect, actual)
+	if err != nil {
+		return 0, 0, err
+	}
+	if is_new {
+		fmt.Fprintf(writer, "%snew file mode %#o%s\n", colors.header, mode, colors.reset)
+	} else if actual_info.Mode().Perm() != mode {
+		fmt.Fprintf(writer, "%sold mode %#o%s\n", colors.header, actual_info.Mode().Perm(), colors.reset)
+		fmt.Fprintf(writer, "%snew mode %#o%s\n", colors.header, mode, colors.reset)
+	}
+	if !is_new && bytes.Equal(expect_contents, actual_contents) {
+		// Only the mode differs.
+		return 0, 0, nil
+	}
+	if strings.HasSuffix(expect, encrypted_suffix) {
+		if !bytes.Equal(expect_contents, actual_contents) {
+			fmt.Fprintf(writer, "Encrypted files %s and %s differ\n", display_actual, display_expect)
+		}
+		return 0, 0, nil
+	}
+	if bytes.IndexByte(expect_contents, 0) >= 0 || bytes.IndexByte(actual_contents, 0) >= 0 {
+		if !bytes.Equal(expect_contents, actual_contents) {
+			fmt.Fprintf(writer, "Binary files %s and %s differ\n", display_actual, display_expect)
+		}
+		return 0, 0, nil
+	}
+	if is_new {
+		fmt.Fprintf(writer, "%s--- /dev/null%s\n", colors.header, colors.reset)
+	} else {
+		fmt.Fprintf(writer, "%s--- %s%s\n", colors.header, display_actual, colors.reset)
+	}
+	fmt.Fprintf(writer, "%s+++ %s%s\n", colors.header, display_expect, colors.reset)
+
+	ops := diff_lines(split_lines(actual_contents), split_lines(expect_contents))
+	// Each hunk covers the changes that are within twice the context of each other.
+	for start := 0; start < len(ops); {
+		for start < len(ops) && ops[start].Kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		end := start
+		for last_change := start; end < len(ops); end++ {
+			if ops[end].Kind != ' ' {
+				last_change = end
+			} else if end-last_change > 2*diff_context_lines {
+				end = last_change + 1
+				break
+			}
+		}
+		for end > start && ops[end-1].Kind == ' ' {
+			end--
+		}
+		hunk_start := max(start-diff_context_lines, 0)
+		hunk_end := min(end+diff_context_lines, len(ops))
+
+		// Line numbers of the hunk's first line in each file, counted from ops before the hunk.
+		a_line, b_line := 1, 1
+		for _, op := range ops[:hunk_start] {
+			if op.Kind != '+' {
+				a_line++
+			}
+			if op.Kind != '-' {
+				b_line++
+			}
+		}
+		a_length, b_length := 0, 0
+		for _, op := range ops[hunk_start:hunk_end] {
+			if op.Kind != '+' {
+				a_length++
+			}
+			if op.Kind != '-' {
+				b_length++
+			}
+		}
+		// An empty range starts at the line before it, as in GNU diff.
+		if a_length == 0 {
+			a_line--
+		}
+		if b_length == 0 {
+			b_line--
+		}
+		fmt.Fprintf(writer, "%s@@ -%d,%d +%d,%d @@%s\n", colors.hunk, a_line, a_length, b_line, b_length, colors.reset)
+		for _, op := range ops[hunk_start:hunk_end] {
+			color := ""
+			switch op.Kind {
+			case '-':
+				color = colors.removed
+				removed++
+			case '+':
+				color = colors.added
+				added++
+			}
+			line, has_newline := strings.CutSuffix(op.Line, "\n")
+			fmt.Fprintf(writer, "%s%c%s%s\n", color, op.Kind, line, colors.reset)
+			if !has_newline {
+				fmt.Fprintln(writer, "\\ No newline at end of file")
+			}
+		}
+		start = hunk_end
+	}
+	return added, removed, nil
+}
+
+// Prints the diff of every mismatched dotfile followed by a diffstat-like summary. files maps repo files to HOME files.
+func write_dotfile_diffs(writer io.Writer, files map[string]string, lgr *itlog.Logger) (ok bool) {
+	colors := diff_colors(writer == io.Writer(os.Stdout) && use_color())
+	total_added, total_removed := 0, 0
+	type Stat struct {
+		path           string
+		added, removed int
+	}
+	var stats []Stat
+	ok = true
+	for _, expect := range slices.SortedFunc(maps.Keys(files), func(a, b string) int { return strings.Compare(files[a], files[b]) }) {
+		actual := files[expect]
+		added, removed, err := write_dotfile_diff(writer, expect, actual, colors)
+		if err != nil {
+			lgr.Error(err).Str("file", actual).Msg("diffing dotfile")
+			ok = false
+			continue
+		}
+		total_added += added
+		total_removed += removed
+		stats = append(stats, Stat{display_home_path(actual), added, removed})
+	}
+	if len(stats) == 0 {
+		return ok
+	}
+	fmt.Fprintln(writer)
+	table := tabwriter.NewWriter(writer, 0, 0, 1, ' ', 0)
+	for _, stat := range stats {
+		fmt.Fprintf(table, " %s\t| %s+%d%s %s-%d%s\n", stat.path, colors.added, stat.added, colors.reset, colors.removed, stat.removed, colors.reset)
+	}
+	table.Flush()
+	fmt.Fprintf(writer, " %d files changed, %d insertions(+), %d deletions(-)\n", len(stats), total_added, total_removed)
+	return ok
+}
+
+// Shows what a sync would write without writing anything. Optional paths limit the diff to those HOME files.
+func command_diff(lgr *itlog.Logger, arguments []string) (exit_code int) {
+	files, _, ok := mismatched_dotfiles(lgr)
+	if !ok {
+		return exit_failure
+	}
+	if len(arguments) > 0 {
+		wanted := make(map[string]bool, len(arguments))
+		for _, argument := range arguments {
+			path := argument
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(invocation_dir, path)
+			}
+			wanted[filepath.Clean(path)] = true
+		}
+		maps.DeleteFunc(files, func(_, actual string) bool { return !wanted[actual] })
+	}
+	if len(files) == 0 {
+		fmt.Println("dotfiles are in sync")
+		return exit_ok
+	}
+	if !write_dotfile_diffs(os.Stdout, files, lgr) {
+		return exit_failure
+	}
+	return exit_ok
+}
+
+// === Three-way merge ===
+
+// How a mismatched dotfile changed since big_bang last wrote it, judged by the hash in its Dotfile_Record.
+const (
+	// Not in HOME yet.
+	dotfile_new = "new"
+	// big_bang never wrote it so there's no telling who changed it. It's overwritten like before records existed.
+	dotfile_untracked    = "untracked"
+	dotfile_repo_changed = "repo changed"
+	dotfile_home_changed = "home changed"
+	// Changed both locally and in the repo.
+	dotfile_conflict = "conflict"
+)
+
+const (
+	conflict_ask    = "ask"
+	conflict_merge  = "merge"
+	conflict_mine   = "mine"
+	conflict_theirs = "theirs"
+	// Only chosen at the prompt or when nobody can be asked.
+	conflict_skip = "skip"
+)
+
+func classify_dotfile(state *State, expect, actual string) (class string, err error) {
+	actual_contents, err := os.ReadFile(actual)
+	if errors.Is(err, fs.ErrNotExist) {
+		return dotfile_new, nil
+	} else if err != nil {
+		return "", err
+	}
+	state.mutex.Lock()
+	record, ok := state.Dotfiles[actual]
+	state.mutex.Unlock()
+	if !ok {
+		return dotfile_untracked, nil
+	}
+	if record.Symlink != "" {
+		// A link that still points where big_bang made it point only mismatches because the rules now copy the file.
+		if target, err := os.Readlink(actual); err == nil && target == record.Symlink {
+			return dotfile_repo_changed, nil
+		}
+		return dotfile_home_changed, nil
+	}
+	expect_contents, err := read_dotfile_source(expect)
+	if err != nil {
+		return "", err
+	}
+	repo_sha, err := dotfile_record_sha(expect, expect_contents)
+	if err != nil {
+		return "", err
+	}
+	repo_changed := repo_sha != record.Sha256
+	actual_checksum := sha256.Sum256(actual_contents)
+	home_changed := hex.EncodeToString(actual_checksum[:]) != record.Sha256
+	if strings.HasSuffix(expect, encrypted_suffix) {
+		// There's no hash of what was written. While the repo file is the same it's what HOME should still hold.
+		// Otherwise the file has only been edited if it was modified after big_bang wrote it.
+		home_changed = !bytes.Equal(actual_contents, expect_contents)
+		if repo_changed {
+			home_changed, err = dotfile_modified_since_written(actual, record)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	switch {
+	case home_changed && repo_changed:
+		return dotfile_conflict, nil
+	case home_changed:
+		return dotfile_home_changed, nil
+	default:
+		// Mismatched files differ so at least one side changed.
+		return dotfile_repo_changed, nil
+	}
+}
+
+func ask_conflict_resolution(expect, actual string) (resolution string) {
+	for {
+		fmt.Printf("%s was edited locally and in the repo. (m)erge, keep (y)ours, take (t)heirs, show (d)iff, or (s)kip? [s] ", display_home_path(actual))
+		answer, _ := stdin.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "m", "merge":
+			return conflict_merge
+		case "y", "yours", "mine":
+			return conflict_mine
+		case "t", "theirs":
+			return conflict_theirs
+		case "d", "diff":
+			write_dotfile_diff(os.Stdout, expect, actual, diff_colors(use_color()))
+		default:
+			return conflict_skip
+		}
+	}
+}
+
+// Merge bases are kept by content under BIG_BANG_DATA_DIR/dotfile_bases/<sha256>.
+func dotfile_base_path(sha string) string {
+	invariant.Always(sha != "", "")
+	return filepath.Join(BIG_BANG_DATA_DIR, "dotfile_bases", sha)
+}
+
+// Removes the bases that no record refers to anymore.
+func prune_dotfile_bases(state *State) error {
+	state.mutex.Lock()
+	referenced := make(map[string]bool, len(state.Dotfiles))
+	for _, record := range state.Dotfiles {
+		referenced[record.Sha256] = true
+	}
+	state.mutex.Unlock()
+	entries, err := os.ReadDir(filepath.Dir(dotfile_base_path("-")))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !referenced[entry.Name()] {
+			if err := os.Remove(dotfile_base_path(entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Merges the local edits in HOME with the repo's changes, using what big_bang last wrote as the base. Overlapping edits
+// are written out with diff3-style conflict markers.
+func merge_dotfile(state *State, expect, actual string) (merged []byte, conflicts int, err error) {
+	state.mutex.Lock()
+	record, ok := state.Dotfiles[actual]
+	state.mutex.Unlock()
+	invariant.Always(ok, "Conflicting dotfiles have a record")
+	if strings.HasSuffix(expect, encrypted_suffix) {
+		return nil, 0, errors.New("encrypted dotfiles can't be merged. pick mine or theirs")
+	}
+	if strategy, err := dotfile_strategy(expect, actual); err != nil {
+		return nil, 0, err
+	} else if strategy == strategy_symlink {
+		return nil, 0, errors.New("symlinked dotfiles can't be merged. pick mine or theirs")
+	}
+	base, err := os.ReadFile(dotfile_base_path(record.Sha256))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, errors.New("the version big_bang last wrote wasn't kept so there's no merge base. pick mine or theirs")
+	} else if err != nil {
+		return nil, 0, err
+	}
+	mine, err := os.ReadFile(actual)
+	if err != nil {
+		return nil, 0, err
+	}
+	theirs, err := read_dotfile_source(expect)
+	if err != nil {
+		return nil, 0, err
+	}
+	if bytes.IndexByte(mine, 0) >= 0 || bytes.IndexByte(theirs, 0) >= 0 {
+		return nil, 0, errors.New("can't merge binary files. pick mine or theirs")
+	}
+	lines, conflicts := merge_lines(
+		split_lines(base), split_lines(mine), split_lines(theirs),
+		display_home_path(actual), strings.TrimPrefix(expect, BIG_BANG_GIT_DIR+string(filepath.Separator)),
+	)
+	return []byte(strings.Join(lines, "")), conflicts, nil
+}
+
+// A change to base[start:end], which is replaced by lines.
+type Merge_Hunk struct {
+	start, end int
+	lines      []string
+}
+
+func merge_hunks(base, other []string) (hunks []Merge_Hunk) {
+	base_index := 0
+	var current *Merge_Hunk
+	for _, op := range diff_lines(base, other) {
+		if op.Kind == ' ' {
+			if current != nil {
+				hunks = append(hunks, *current)
+				current = nil
+			}
+			base_index++
+			continue
+		}
+		if current == nil {
+			current = &Merge_Hunk{start: base_index, end: base_index}
+		}
+		if op.Kind == '-' {
+			base_index++
+			current.end = base_index
+		} else {
+			current.lines = append(current.lines, op.Line)
+		}
+	}
+	if current != nil {
+		hunks = append(hunks, *current)
+	}
+	return hunks
+}
+
+// Lines are expected to keep their line endings, as split_lines returns them.
+func merge_lines(base, mine, theirs []string, mine_label, theirs_label string) (merged []string, conflicts int) {
+	mine_hunks := merge_hunks(base, mine)
+	theirs_hunks := merge_hunks(base, theirs)
+	// Rebuilds one side's version of base[start:end] from its hunks in that range.
+	apply := func(hunks []Merge_Hunk, start, end int) (lines []string) {
+		position := start
+		for _, hunk := range hunks {
+			lines = append(lines, base[position:hunk.start]...)
+			lines = append(lines, hunk.lines...)
+			position = hunk.end
+		}
+		return append(lines, base[position:end]...)
+	}
+	terminate := func(lines []string) []string {
+		if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+			lines[n-1] += "\n"
+		}
+		return lines
+	}
+
+	position := 0
+	for len(mine_hunks) > 0 || len(theirs_hunks) > 0 {
+		// Grow a group from the earliest hunk until no hunk on either side touches it. Adjacent edits conflict, as in git.
+		start := math.MaxInt
+		if len(mine_hunks) > 0 {
+			start = mine_hunks[0].start
+		}
+		if len(theirs_hunks) > 0 {
+			start = min(start, theirs_hunks[0].start)
+		}
+		end := start
+		mine_count, theirs_count := 0, 0
+		for grew := true; grew; {
+			grew = false
+			if mine_count < len(mine_hunks) && mine_hunks[mine_count].start <= end {
+				end = max(end, mine_hunks[mine_count].end)
+				mine_count++
+				grew = true
+			}
+			if theirs_count < len(theirs_hunks) && theirs_hunks[theirs_count].start <= end {
+				end = max(end, theirs_hunks[theirs_count].end)
+				theirs_count++
+				grew = true
+			}
+		}
+		merged = append(merged, base[position:start]...)
+		mine_version := apply(mine_hunks[:mine_count], start, end)
+		theirs_version := apply(theirs_hunks[:theirs_count], start, end)
+		switch {
+		case theirs_count == 0:
+			merged = append(merged, mine_version...)
+		case mine_count == 0, slices.Equal(mine_version, theirs_version):
+			merged = append(merged, theirs_version...)
+		default:
+			conflicts++
+			merged = append(merged, "<<<<<<< "+mine_label+"\n")
+			merged = append(merged, terminate(mine_version)...)
+			merged = append(merged, "||||||| last synced\n")
+			merged = append(merged, terminate(slices.Clone(base[start:end]))...)
+			merged = append(merged, "=======\n")
+			merged = append(merged, terminate(theirs_version)...)
+			merged = append(merged, ">>>>>>> "+theirs_label+"\n")
+		}
+		position = end
+		mine_hunks = mine_hunks[mine_count:]
+		theirs_hunks = theirs_hunks[theirs_count:]
+	}
+	return append(merged, base[position:]...), conflicts
+}
+
+// === Backups ===
+
+// Backups mirror HOME under BIG_BANG_DATA_DIR/backups/<run>/ where run is the id of the run that overwrote them, which is
+// also the name of its log.
+func backups_dir() string {
+	return filepath.Join(BIG_BANG_DATA_DIR, "backups")
+}
+
+// Copies a dotfile into the backup tree of a run before it's overwritten or deleted. Files that don't exist yet have
+// nothing to lose so they're skipped. Secrets, such as decrypted .enc files, are only readable by their owner whatever
+// mode they had in HOME.
+func backup_dotfile(run_id, path string, secret bool) error {
+	invariant.Always(run_id != "", "Backups belong to a run")
+	invariant.Always(path_is_within(HOME, path) && path != HOME, "Dotfiles live in HOME")
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	relative, err := filepath.Rel(HOME, path)
+	if err != nil {
+		return err
+	}
+	destination := filepath.Join(backups_dir(), run_id, relative)
+	// Keep the first copy if a run touches the same file twice since that's the one from before the run.
+	if file_exists(destination) {
+		return nil
+	}
+	mode := info.Mode().Perm()
+	if secret || is_sensitive_dotfile(path) {
+		mode &^= 0o077
+	}
+	return copy_file(path, destination, mode)
+}
+
+type Backup struct {
+	Id    string
+	Start time.Time
+	// Relative to HOME.
+	Files []string
+	Size  int64
+}
+
+// Sorted newest first.
+func list_backups() (backups []Backup, err error) {
+	entries, err := os.ReadDir(backups_dir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		start, err := parse_run_id(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		backup := Backup{Id: entry.Name(), Start: start}
+		root := filepath.Join(backups_dir(), entry.Name())
+		if err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			relative, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			backup.Files = append(backup.Files, relative)
+			backup.Size += info.Size()
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		backups = append(backups, backup)
+	}
+	slices.SortFunc(backups, func(a, b Backup) int { return b.Start.Compare(a.Start) })
+	return backups, nil
+}
+
+func command_backups_list(lgr *itlog.Logger, arguments []string) (exit_code int) {
+	if len(arguments) != 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+	backups, err := list_backups()
+	if err != nil {
+		lgr.Error(err).Str("directory", backups_dir()).Msg("listing backups")
+		return exit_failure
+	}
+	if len(backups) == 0 {
+		fmt.Println("no backups")
+		return exit_ok
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "RUN\tFILES\tSIZE\tEXAMPLE")
+	for _, backup := range backups {
+		example := "-"
+		if len(backup.Files) > 0 {
+			example = filepath.Join("~", backup.Files[0])
+		}
+		fmt.Fprintf(table, "%s\t%d\t%s\t%s\n", backup.Id, len(backup.Files), format_bytes(backup.Size), example)
+	}
+	table.Flush()
+	return exit_ok
+}
+
+func command_backups_prune(lgr *itlog.Logger, arguments []string) (exit_code int) {
+	flags := flag.NewFlagSet("backups prune", flag.ContinueOnError)
+	keep := flags.Int("keep", 10, "number of backups to keep")
+	max_age := flags.Int("max-age", 0, "delete backups older than this many days. 0 keeps them regardless of age")
+	yes := flags.Bool("yes", false, "delete without asking for confirmation")
+	positional, err := parse_flags(flags, arguments)
+	if err != nil || len(positional) != 0 || *keep < 0 || *max_age < 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+	backups, err := list_backups()
+	if err != nil {
+		lgr.Error(err).Str("directory", backups_dir()).Msg("listing backups")
+		return exit_failure
+	}
+	var doomed []Backup
+	for i, backup := range backups {
+		too_old := *max_age > 0 && time.Since(backup.Start) > time.Duration(*max_age)*time.Hour*24
+		if i >= *keep || too_old {
+			doomed = append(doomed, backup)
+		}
+	}
+	if len(doomed) == 0 {
+		fmt.Println("nothing to prune")
+		return exit_ok
+	}
+	var total int64
+	for _, backup := range doomed {
+		total += backup.Size
+		fmt.Printf("%s (%d files)\n", backup.Id, len(backup.Files))
+	}
+	if !*yes && !confirm(fmt.Sprintf("delete %d backups (%s)?", len(doomed), format_bytes(total))) {
+		return exit_ok
+	}
+	for _, backup := range doomed {
+		if err := os.RemoveAll(filepath.Join(backups_dir(), backup.Id)); err != nil {
+			lgr.Error(err).Str("backup", backup.Id).Msg("pruning backup")
+			return exit_failure
+		}
+	}
+	return exit_ok
+}
+
+// Restoring backs up the files it overwrites as well, so a restore can be undone with another restore.
+func command_restore(lgr *itlog.Logger, arguments []string) (exit_code int) {
+	if len(arguments) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+	backups, err := list_backups()
+	if err != nil {
+		lgr.Error(err).Str("directory", backups_dir()).Msg("listing backups")
+		return exit_failure
+	}
+	matches := slices.DeleteFunc(backups, func(backup Backup) bool { return !strings.HasPrefix(backup.Id, arguments[0]) })
+	if len(matches) != 1 {
+		fmt.Fprintf(os.Stderr, "%q matches %d backups. see `backups list`\n", arguments[0], len(matches))
+		return exit_failure
+	}
+	backup := matches[0]
+	files := backup.Files
+	if len(arguments) > 1 {
+		files = nil
+		for _, argument := range arguments[1:] {
+			path := argument
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(invocation_dir, path)
+			}
+			relative, err := filepath.Rel(HOME, filepath.Clean(path))
+			if err != nil || !path_is_within(HOME, path) {
+				fmt.Fprintf(os.Stderr, "%s is not in HOME\n", argument)
+				return exit_usage
+			}
+			if !slices.Contains(backup.Files, relative) {
+				fmt.Fprintf(os.Stderr, "%s is not in backup %s\n", argument, backup.Id)
+				return exit_failure
+			}
+			files = append(files, relative)
+		}
+	}
+
+	lgr.Info().Begin("restoring")
+	undo_id := time.Now().UTC().Format(run_log_time_format)
+	for _, relative := range files {
+		source := filepath.Join(backups_dir(), backup.Id, relative)
+		destination := filepath.Join(HOME, relative)
+		info, err := os.Stat(source)
+		if err != nil {
+			lgr.Error(err).Str("file", source).Msg("reading backup")
+			return exit_failure
+		}
+		if current, err := os.Lstat(destination); err == nil && current.Mode() == info.Mode() && file_contents_are_equal(source, destination) {
+			continue
+		}
+		if err := backup_dotfile(undo_id, destination, false); err != nil {
+			lgr.Error(err).Str("file", destination).Msg("backing up before restoring")
+			return exit_failure
+		}
+		// Restoring through a symlink made by strategy_symlink would overwrite the repo file.
+		if link, err := os.Lstat(destination); err == nil && link.Mode()&fs.ModeSymlink != 0 {
+			if err := os.Remove(destination); err != nil {
+				lgr.Error(err).Str("file", destination).Msg("removing symlink before restoring")
+				return exit_failure
+			}
+		}
+		if err := copy_file(source, destination, info.Mode().Perm()); err != nil {
+			lgr.Error(err).Str("file", destination).Msg("restoring")
+			return exit_failure
+		}
+		lgr.Info().Str("file", destination).Msg("restored")
+	}
+	lgr.Info().Done("restoring")
+	return exit_ok
+}
+
+const (
+	outcome_unchanged = "unchanged"
+	outcome_installed = "installed"
+	outcome_upgraded  = "upgraded"
+	outcome_failed    = "failed"
+	outcome_skipped   = "skipped"
+	outcome_removed   = "removed"
+)
+
+type Report_Entry struct {
+	// One of artifact, dotfile, or step.
+	Kind     string
+	Name     string
+	Outcome  string
+	Reason   string
+	Duration time.Duration
+}
+
+// Collects the outcome of everything a run touched so it can be summarized at the end.
+type Run_Report struct {
+	mutex   sync.Mutex
+	Entries []Report_Entry
+}
+
+func (report *Run_Report) add(entry Report_Entry) {
+	invariant.Always(slices.Contains(
+		[]string{outcome_unchanged, outcome_installed, outcome_upgraded, outcome_removed, outcome_failed, outcome_skipped},
+		entry.Outcome,
+	), "Report entries have a known outcome")
+	events.emit(Event{
+		Type:        "outcome",
+		Kind:        entry.Kind,
+		Name:        entry.Name,
+		Outcome:     entry.Outcome,
+		Reason:      entry.Reason,
+		Duration_Ms: entry.Duration.Milliseconds(),
+	})
+	if entry.Kind == "artifact" {
+		progress.finish(entry.Name, entry.Outcome)
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Entries = append(report.Entries, entry)
+}
+
+func (report *Run_Report) counts() map[string]int {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	counts := make(map[string]int)
+	for _, entry := range report.Entries {
+		counts[entry.Outcome]++
+	}
+	return counts
+}
+
+func (report *Run_Report) failed() bool {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	return slices.ContainsFunc(report.Entries, func(entry Report_Entry) bool { return entry.Outcome == outcome_failed })
+}
+
+// Failed entries turn a successful run into exit_failure. A usage or setup error is kept since it says more about what
+// went wrong.
+func (report *Run_Report) exit_code(command_exit_code int) int {
+	if command_exit_code == exit_ok && report.failed() {
+		return exit_failure
+	}
+	return command_exit_code
+}
+
+// Unchanged dotfiles are collapsed into a single row since there are dozens of them on every run.
+func (report *Run_Report) print(writer io.Writer) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	entries := slices.Clone(report.Entries)
+	slices.SortStableFunc(entries, func(a, b Report_Entry) int {
+		return cmp.Or(strings.Compare(a.Kind, b.Kind), strings.Compare(a.Name, b.Name))
+	})
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "KIND\tNAME\tOUTCOME\tDURATION\tREASON")
+	unchanged_dotfiles := 0
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		counts[entry.Outcome]++
+		if entry.Kind == "dotfile" && entry.Outcome == outcome_unchanged {
+			unchanged_dotfiles++
+			continue
+		}
+		duration := "-"
+		if entry.Duration > 0 {
+			duration = entry.Duration.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", entry.Kind, entry.Name, entry.Outcome, duration, entry.Reason)
+	}
+	if unchanged_dotfiles > 0 {
+		fmt.Fprintf(table, "dotfile\t(%d files)\t%s\t-\t\n", unchanged_dotfiles, outcome_unchanged)
+	}
+	table.Flush()
+	fmt.Fprintf(writer, "%d unchanged, %d installed, %d upgraded, %d removed, %d failed, %d skipped\n",
+		counts[outcome_unchanged], counts[outcome_installed], counts[outcome_upgraded], counts[outcome_removed],
+		counts[outcome_failed], counts[outcome_skipped],
+	)
+}
+
+// === Machine-readable output ===
+
+// Bump this whenever a field is renamed or removed, or its meaning changes. Adding fields is backwards compatible.
+const json_schema_version = 1
+
+// A single line of the --output=json event stream. Fields that don't apply to an event type are omitted.
+type Event struct {
+	Schema_Version int       `json:"schema_version"`
+	Time           time.Time `json:"time"`
+	Type           string    `json:"type"`
+	Phase          string    `json:"phase,omitempty"`
+	Kind           string    `json:"kind,omitempty"`
+	Name           string    `json:"name,omitempty"`
+	Outcome        string    `json:"outcome,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	Path           string    `json:"path,omitempty"`
+	Source         string    `json:"source,omitempty"`
+	Bytes          int64     `json:"bytes,omitempty"`
+	Sha256         string    `json:"sha256,omitempty"`
+	Cached         bool      `json:"cached,omitempty"`
+	Duration_Ms    int64     `json:"duration_ms,omitempty"`
+	// A pointer so that a successful run still reports exit_code 0.
+	Exit_Code *int           `json:"exit_code,omitempty"`
+	Outcomes  map[string]int `json:"outcomes,omitempty"`
+}
+
+type Event_Stream struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// Set for the duration of a run with --output=json. emit is a no-op otherwise so call sites don't need to check.
+var events *Event_Stream
+
+func (stream *Event_Stream) emit(event Event) {
+	if stream == nil {
+		return
+	}
+	invariant.Always(event.Type != "", "Events have a type")
+	event.Schema_Version = json_schema_version
+	event.Time = time.Now().UTC()
+	line, err := json.Marshal(event)
+	invariant.Always(err == nil, "Events always marshal")
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.writer.Write(append(line, '\n'))
+}
+
+func write_json(writer io.Writer, value any) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+type Status_Artifact struct {
+	Name         string    `json:"name"`
+	Managed      bool      `json:"managed"`
+	Version      string    `json:"version,omitempty"`
+	Expected     string    `json:"expected_version,omitempty"`
+	Installed_At time.Time `json:"installed_at,omitzero"`
+	Files        int       `json:"files"`
+}
+
+type Status_Dotfile struct {
+	Path       string    `json:"path"`
+	Source     string    `json:"source"`
+	Sha256     string    `json:"sha256"`
+	Written_At time.Time `json:"written_at"`
+}
+
+// Reports what the state file says is installed. It doesn't touch the network or run any health checks.
+func command_status(state *State, lgr *itlog.Logger, arguments []string) (exit_code int) {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	output := flags.String("output", "text", "text or json")
+	positional, err := parse_flags(flags, arguments)
+	if err != nil || len(positional) != 0 || (*output != "text" && *output != "json") {
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+	artifacts := artifact_manifest()
+	var statuses []Status_Artifact
+	for _, name := range slices.Sorted(maps.Keys(artifacts)) {
+		status := Status_Artifact{Name: name, Expected: artifacts[name].Version}
+		if record, ok := state.Artifacts[name]; ok {
+			status.Managed = true
+			status.Version = record.Version
+			status.Installed_At = record.Installed_At
+			status.Files = len(record.Files)
+		}
+		statuses = append(statuses, status)
+	}
+	var dotfiles []Status_Dotfile
+	for _, destination := range slices.Sorted(maps.Keys(state.Dotfiles)) {
+		record := state.Dotfiles[destination]
+		dotfiles = append(dotfiles, Status_Dotfile{Path: destination, Source: record.Source, Sha256: record.Sha256, Written_At: record.Written_At})
+	}
+	if *output == "json" {
+		err := write_json(os.Stdout, struct {
+			Schema_Version int               `json:"schema_version"`
+			Artifacts      []Status_Artifact `json:"artifacts"`
+			Dotfiles       []Status_Dotfile  `json:"dotfiles"`
+		}{json_schema_version, statuses, dotfiles})
+		if err != nil {
+			lgr.Error(err).Msg("writing status")
+			return exit_failure
+		}
+		return exit_ok
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ARTIFACT\tVERSION\tEXPECTED\tFILES\tINSTALLED")
+	for _, status := range statuses {
+		if !status.Managed {
+			fmt.Fprintf(table, "%s\t-\t%s\t-\tnot managed\n", status.Name, cmp.Or(status.Expected, "-"))
+			continue
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\n",
+			status.Name, cmp.Or(status.Version, "-"), cmp.Or(status.Expected, "-"), status.Files, status.Installed_At.Format(time.DateTime),
+		)
+	}
+	table.Flush()
+	fmt.Printf("%d dotfiles managed\n", len(dotfiles))
+	return exit_ok
+}
+
+type Check_Result struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Reports what a run would change without changing anything. Exits with exit_failure if a run has work to do.
+func command_check(state *State, lgr *itlog.Logger, arguments []string) (exit_code int) {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	output := flags.String("output", "text", "text or json")
+	positional, err := parse_flags(flags, arguments)
+	if err != nil || len(positional) != 0 || (*output != "text" && *output != "json") {
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+	if *output == "json" {
+		lgr = itlog.New(os.Stderr, console_log_level)
+	}
+	artifacts := artifact_manifest()
+	health := &Health_Cache{}
+	health.probe(artifacts, lgr)
+	var results []Check_Result
+	for _, name := range slices.Sorted(maps.Keys(artifacts)) {
+		result := Check_Result{Kind: "artifact", Name: name, Ok: true}
+		if err := health.get(name); err != nil {
+			result.Ok = false
+			result.Reason = err.Error()
+		}
+		results = append(results, result)
+	}
+	files, matched, ok := mismatched_dotfiles(lgr)
+	if !ok {
+		results = append(results, Check_Result{Kind: "dotfile", Name: "dotfiles", Reason: "collecting dotfiles failed"})
+	}
+	for _, actual := range matched {
+		results = append(results, Check_Result{Kind: "dotfile", Name: actual, Ok: true})
+	}
+	for _, expect := range slices.Sorted(maps.Keys(files)) {
+		reason := "differs from " + expect
+		if class, err := classify_dotfile(state, expect, files[expect]); err == nil {
+			reason = class + ", " + reason
+		}
+		results = append(results, Check_Result{Kind: "dotfile", Name: files[expect], Reason: reason})
+	}
+	if stale_files, err := stale_dotfiles(state); err != nil {
+		results = append(results, Check_Result{Kind: "dotfile", Name: "dotfiles", Reason: "finding dotfiles removed from the repo failed: " + err.Error()})
+	} else if ok {
+		for _, stale := range stale_files {
+			if stale.Kind == stale_missing {
+				continue
+			}
+			reason := "removed from the repo"
+			if stale.Kind == stale_modified {
+				reason += " but edited locally"
+			}
+			results = append(results, Check_Result{Kind: "dotfile", Name: stale.Path, Reason: reason})
+		}
+	}
+	slices.SortStableFunc(results, func(a, b Check_Result) int {
+		return cmp.Or(strings.Compare(a.Kind, b.Kind), strings.Compare(a.Name, b.Name))
+	})
+	exit_code = exit_ok
+	if slices.ContainsFunc(results, func(result Check_Result) bool { return !result.Ok }) {
+		exit_code = exit_failure
+	}
+	if *output == "json" {
+		err := write_json(os.Stdout, struct {
+			Schema_Version int            `json:"schema_version"`
+			Ok             bool           `json:"ok"`
+			Results        []Check_Result `json:"results"`
+		}{json_schema_version, exit_code == exit_ok, results})
+		if err != nil {
+			lgr.Error(err).Msg("writing check results")
+			return exit_failure
+		}
+		return exit_code
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "STATUS\tKIND\tNAME\tREASON")
+	for _, result := range results {
+		if result.Ok {
+			continue
+		}
+		fmt.Fprintf(table, "needs action\t%s\t%s\t%s\n", result.Kind, result.Name, result.Reason)
+	}
+	table.Flush()
+	if exit_code == exit_ok {
+		fmt.Println("nothing to do")
+	}
+	return exit_code
+}
+
+// === Tracing ===
+
+type Span struct {
+	Name string
+	// Empty for spans that aren't about a single artifact.
+	Artifact string
+	Start    time.Time
+	End      time.Time
+}
+
+// Records how long each phase of a run took. Set for the duration of a run. span is a no-op otherwise.
+type Tracer struct {
+	mutex sync.Mutex
+	start time.Time
+	spans []Span
+}
+
+var tracer *Tracer
+
+// Usage:
+//
+//	defer tracer.span("downloading", artifact.Name)()
+//
+// Unlike itlog's Done, the span ends on every return path, so failures are measured too.
+func (tracer *Tracer) span(name, artifact string) (end func()) {
+	if tracer == nil {
+		return func() {}
+	}
+	progress.step(artifact, name)
+	start := time.Now()
+	return func() {
+		span := Span{Name: name, Artifact: artifact, Start: start, End: time.Now()}
+		events.emit(Event{Type: "span", Phase: name, Name: artifact, Duration_Ms: span.End.Sub(span.Start).Milliseconds()})
+		tracer.mutex.Lock()
+		defer tracer.mutex.Unlock()
+		tracer.spans = append(tracer.spans, span)
+	}
+}
+
+// Totals add up concurrent spans so they can exceed the duration of the run.
+func (tracer *Tracer) print_breakdown(writer io.Writer) {
+	if tracer == nil {
+		return
+	}
+	type Total struct {
+		name     string
+		count    int
+		total    time.Duration
+		slowest  Span
+		duration time.Duration
+	}
+	tracer.mutex.Lock()
+	totals := make(map[string]*Total)
+	for _, span := range tracer.spans {
+		total, ok := totals[span.Name]
+		if !ok {
+			total = &Total{name: span.Name}
+			totals[span.Name] = total
+		}
+		duration := span.End.Sub(span.Start)
+		total.count++
+		total.total += duration
+		if duration > total.duration {
+			total.slowest = span
+			total.duration = duration
+		}
+	}
+	tracer.mutex.Unlock()
+	if len(totals) == 0 {
+		return
+	}
+	sorted := slices.SortedFunc(maps.Values(totals), func(a, b *Total) int {
+		return cmp.Or(cmp.Compare(b.total, a.total), strings.Compare(a.name, b.name))
+	})
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "SPAN\tCOUNT\tTOTAL\tSLOWEST")
+	for _, total := range sorted {
+		slowest := total.duration.Round(time.Millisecond).String()
+		if total.slowest.Artifact != "" {
+			slowest += " (" + total.slowest.Artifact + ")"
+		}
+		fmt.Fprintf(table, "%s\t%d\t%s\t%s\n", total.name, total.count, total.total.Round(time.Millisecond), slowest)
+	}
+	table.Flush()
+	fmt.Fprintf(writer, "%s wall clock\n", time.Since(tracer.start).Round(time.Millisecond))
+}
+
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+// Each artifact gets its own thread so that concurrent downloads are drawn side by side.
+func (tracer *Tracer) write_chrome_trace(path string) error {
+	invariant.Always(tracer != nil, "Traces are only written during a run")
+	type Trace_Event struct {
+		Name      string            `json:"name"`
+		Category  string            `json:"cat,omitempty"`
+		Phase     string            `json:"ph"`
+		Timestamp int64             `json:"ts"`
+		Duration  int64             `json:"dur,omitempty"`
+		Pid       int               `json:"pid"`
+		Tid       int               `json:"tid"`
+		Args      map[string]string `json:"args,omitempty"`
+	}
+	tracer.mutex.Lock()
+	spans := slices.Clone(tracer.spans)
+	tracer.mutex.Unlock()
+	slices.SortFunc(spans, func(a, b Span) int { return a.Start.Compare(b.Start) })
+
+	threads := map[string]int{"": 0}
+	trace_events := []Trace_Event{{Name: "thread_name", Phase: "M", Args: map[string]string{"name": "big_bang"}}}
+	for _, span := range spans {
+		tid, ok := threads[span.Artifact]
+		if !ok {
+			tid = len(threads)
+			threads[span.Artifact] = tid
+			trace_events = append(trace_events, Trace_Event{Name: "thread_name", Phase: "M", Tid: tid, Args: map[string]string{"name": span.Artifact}})
+		}
+		trace_event := Trace_Event{
+			Name:      span.Name,
+			Category:  "big_bang",
+			Phase:     "X",
+			Timestamp: span.Start.Sub(tracer.start).Microseconds(),
+			Duration:  span.End.Sub(span.Start).Microseconds(),
+			Tid:       tid,
+		}
+		if span.Artifact != "" {
+			trace_event.Args = map[string]string{"artifact": span.Artifact}
+		}
+		trace_events = append(trace_events, trace_event)
+	}
+	contents, err := json.Marshal(map[string]any{"traceEvents": trace_events, "displayTimeUnit": "ms"})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, contents, 0o644)
+}
+
+// === Progress ===
+
+const progress_redraw_interval = time.Millisecond * 100
+
+type Progress_Row struct {
+	step       string
+	step_start time.Time
+	bytes      int64
+	// Zero or negative if the server didn't send Content-Length.
+	total   int64
+	outcome string
+}
+
+// A live view with one line per artifact, redrawn in place. Only used when stdout is a terminal. Log lines written to it
+// are printed above the view.
+type Progress struct {
+	mutex    sync.Mutex
+	terminal io.Writer
+	rows     map[string]*Progress_Row
+	order    []string
+	// Number of lines drawn last time, which have to be erased before drawing again.
+	drawn   int
+	stopped chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Set for the duration of a run on a terminal. All methods are no-ops otherwise.
+var progress *Progress
+
+func is_terminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+func start_progress(terminal io.Writer) *Progress {
+	progress := &Progress{terminal: terminal, rows: make(map[string]*Progress_Row), stopped: make(chan struct{})}
+	progress.wg.Go(func() {
+		ticker := time.NewTicker(progress_redraw_interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-progress.stopped:
+				return
+			case <-ticker.C:
+				progress.mutex.Lock()
+				progress.redraw()
+				progress.mutex.Unlock()
+			}
+		}
+	})
+	return progress
+}
+
+// Draws the final state and leaves it on screen.
+func (progress *Progress) stop() {
+	if progress == nil {
+		return
+	}
+	close(progress.stopped)
+	progress.wg.Wait()
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.redraw()
+	// Later writes go below the final view instead of erasing it.
+	progress.drawn = 0
+}
+
+func (progress *Progress) row(artifact_name string) *Progress_Row {
+	row, ok := progress.rows[artifact_name]
+	if !ok {
+		row = &Progress_Row{}
+		progress.rows[artifact_name] = row
+		progress.order = append(progress.order, artifact_name)
+	}
+	return row
+}
+
+func (progress *Progress) step(artifact_name, step string) {
+	if progress == nil || artifact_name == "" {
+		return
+	}
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	row := progress.row(artifact_name)
+	*row = Progress_Row{step: step, step_start: time.Now()}
+}
+
+func (progress *Progress) finish(artifact_name, outcome string) {
+	if progress == nil {
+		return
+	}
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.row(artifact_name).outcome = outcome
+}
+
+// Counts the bytes read from body towards the artifact's current step.
+func (progress *Progress) reader(artifact_name string, body io.Reader, total int64) io.Reader {
+	if progress == nil {
+		return body
+	}
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	row := progress.row(artifact_name)
+	row.bytes = 0
+	row.total = total
+	return &Progress_Reader{progress: progress, artifact_name: artifact_name, reader: body}
+}
+
+type Progress_Reader struct {
+	progress      *Progress
+	artifact_name string
+	reader        io.Reader
+}
+
+func (reader *Progress_Reader) Read(buffer []byte) (n int, err error) {
+	n, err = reader.reader.Read(buffer)
+	reader.progress.mutex.Lock()
+	defer reader.progress.mutex.Unlock()
+	reader.progress.row(reader.artifact_name).bytes += int64(n)
+	return n, err
+}
+
+// Prints a log line above the view.
+func (progress *Progress) Write(line []byte) (n int, err error) {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.erase()
+	n, err = progress.terminal.Write(line)
+	progress.draw()
+	return n, err
+}
+
+func (progress *Progress) redraw() {
+	progress.erase()
+	progress.draw()
+}
+
+// Moves the cursor to the first line of the view and clears everything below it.
+func (progress *Progress) erase() {
+	if progress.drawn > 0 {
+		fmt.Fprintf(progress.terminal, "\x1b[%dF\x1b[J", progress.drawn)
+	}
+	progress.drawn = 0
+}
+
+func (progress *Progress) draw() {
+	width := 0
+	for _, name := range progress.order {
+		width = max(width, len(name))
+	}
+	var buffer bytes.Buffer
+	for _, name := range progress.order {
+		row := progress.rows[name]
+		elapsed := time.Since(row.step_start)
+		detail := elapsed.Round(time.Second).String()
+		switch {
+		case row.outcome != "":
+			detail = row.outcome
+		case row.bytes > 0 && row.total > 0:
+			rate := float64(row.bytes) / max(elapsed.Seconds(), 0.001)
+			eta := time.Duration(float64(row.total-row.bytes) / max(rate, 1) * float64(time.Second))
+			detail = fmt.Sprintf("%s / %s  %s/s  eta %s",
+				format_bytes(row.bytes), format_bytes(row.total), format_bytes(int64(rate)), eta.Round(time.Second),
+			)
+		case row.bytes > 0:
+			rate := float64(row.bytes) / max(elapsed.Seconds(), 0.001)
+			detail = fmt.Sprintf("%s  %s/s", format_bytes(row.bytes), format_bytes(int64(rate)))
+		}
+		step := row.step
+		if row.outcome != "" {
+			step = "done"
+		}
+		fmt.Fprintf(&buffer, "%-*s  %-20s  %s\n", width, name, step, detail)
+	}
+	progress.terminal.Write(buffer.Bytes())
+	progress.drawn = len(progress.order)
+}
+
+// === Run history ===
+
+// Runs past either limit are pruned when a new run starts. Set by BIG_BANG_LOG_KEEP and BIG_BANG_LOG_MAX_AGE.
+var (
+	run_log_keep_count = 100
+	run_log_max_age    = time.Hour * 24 * 90
+)
+
+// Doubles as the run id so it sorts chronologically and has no characters that need quoting in a shell. It has
+// milliseconds so runs started within the same second get their own log, see open_run_log.
+const run_log_time_format = "2006-01-02T15-04-05.000Z"
+
+// Runs before ids had milliseconds are still listed.
+func parse_run_id(id string) (start time.Time, err error) {
+	start, err = time.Parse(run_log_time_format, id)
+	if err != nil {
+		start, err = time.Parse("2006-01-02T15-04-05Z", id)
+	}
+	return start, err
+}
+
+var (
+	console_log_level = itlog.LevelInfo
+	file_log_level    = itlog.LevelDebug
+)
+
+func parse_log_level(raw string, fallback int) (level int, err error) {
+	switch strings.ToLower(raw) {
+	case "":
+		return fallback, nil
+	case "debug":
+		return itlog.LevelDebug, nil
+	case "info":
+		return itlog.LevelInfo, nil
+	case "warn":
+		return itlog.LevelWarn, nil
+	case "error":
+		return itlog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", raw)
+	}
+}
+
+func parse_positive_int(raw string, fallback int) (n int, err error) {
+	if raw == "" {
+		return fallback, nil
+	}
+	n, err = strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("expected a positive whole number. got %q", raw)
+	}
+	return n, nil
+}
+
+// Forwards the itlog lines at or above level. itlog hands over exactly one line per Write.
+type Level_Writer struct {
+	writer io.Writer
+	level  int
+}
+
+func (level_writer Level_Writer) Write(line []byte) (n int, err error) {
+	if log_level(string(line)) < level_writer.level {
+		return len(line), nil
+	}
+	return level_writer.writer.Write(line)
+}
+
+// itlog lines are timestamp|level|message|key=value|... with the message padded by spaces. They're split on the
+// delimiters rather than at itlog's column widths. Returns itlog.LevelDisabled for lines that aren't logs, which
+// Level_Writer always forwards.
+func log_level(line string) int {
+	_, rest, _ := strings.Cut(line, "|")
+	word, _, _ := strings.Cut(rest, "|")
+	switch word {
+	case "DBG":
+		return itlog.LevelDebug
+	case "INF":
+		return itlog.LevelInfo
+	case "WRN":
+		return itlog.LevelWarn
+	case "ERR":
+		return itlog.LevelError
+	}
+	return itlog.LevelDisabled
+}
+
+func run_log_dir() string {
+	return filepath.Join(BIG_BANG_DATA_DIR, "logs")
+}
+
+type Run_Log struct {
+	id    string
+	file  *os.File
+	start time.Time
+
+	mutex          sync.Mutex
+	artifact_files map[string]*os.File
+}
+
+// Set for the duration of a run.
+var run_log *Run_Log
+
+// Prunes old logs then creates the log for this run. The first line records which command was run.
+func open_run_log(command string) (*Run_Log, error) {
+	if err := os.MkdirAll(run_log_dir(), 0o755); err != nil {
+		return nil, err
+	}
+	start := time.Now().UTC()
+	runs, err := list_run_logs()
+	if err != nil {
+		return nil, err
+	}
+	for i, run := range runs {
+		// runs is sorted newest first. Leave room for the log about to be created.
+		if i >= run_log_keep_count-1 || start.Sub(run.Start) > run_log_max_age {
+			if err := os.Remove(run.Path); err != nil {
+				return nil, err
+			}
+			if err := os.RemoveAll(strings.TrimSuffix(run.Path, ".log")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var id string
+	var file *os.File
+	for {
+		id = start.Format(run_log_time_format)
+		file, err = os.OpenFile(filepath.Join(run_log_dir(), id+".log"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+		// Another run started within the same millisecond. The next free one keeps the ids in order.
+		start = start.Add(time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	itlog.New(file, itlog.LevelInfo).Info().Str("command", command).Msg("run started")
+	return &Run_Log{id: id, file: file, start: start, artifact_files: make(map[string]*os.File)}, nil
+}
+
+// Console output is filtered separately from the log file so the file can keep debug logs that would drown the
+// terminal.
+func new_run_logger(console io.Writer, console_level int, run_log *Run_Log) *itlog.Logger {
+	if run_log == nil {
+		return itlog.New(console, console_level)
+	}
+	return itlog.New(
+		io.MultiWriter(Level_Writer{console, console_level}, Level_Writer{run_log.file, file_log_level}),
+		min(console_level, file_log_level),
+	)
+}
+
+// Output of the processes spawned for an artifact is kept in BIG_BANG_DATA_DIR/logs/<run>/<artifact>.log. It is also
+// streamed to the terminal unless the progress view owns it. Returns nil, meaning the terminal, outside of a run.
+func (run_log *Run_Log) child_output(artifact_name string) io.Writer {
+	invariant.Always(artifact_name != "", "Child output belongs to an artifact")
+	if run_log == nil {
+		if progress != nil {
+			// Writing to the terminal would tear the progress view. Errors are still returned by spawn.
+			return io.Discard
+		}
+		return nil
+	}
+	run_log.mutex.Lock()
+	defer run_log.mutex.Unlock()
+	file, ok := run_log.artifact_files[artifact_name]
+	if !ok {
+		var err error
+		file, err = func() (*os.File, error) {
+			if err := os.MkdirAll(filepath.Join(run_log_dir(), run_log.id), 0o755); err != nil {
+				return nil, err
+			}
+			return os.Create(filepath.Join(run_log_dir(), run_log.id, artifact_name+".log"))
+		}()
+		if err != nil {
+			// Fall back to the terminal rather than losing the output.
+			if progress != nil {
+				return io.Discard
+			}
+			return nil
+		}
+		run_log.artifact_files[artifact_name] = file
+	}
+	if progress != nil {
+		return file
+	}
+	return io.MultiWriter(child_terminal(), file)
+}
+
+// Where spawned processes print when they're shown. Stdout is reserved for the event stream with --output=json.
+func child_terminal() io.Writer {
+	if events != nil {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Appends the report to the log regardless of the file's level since history depends on it.
+func (run_log *Run_Log) finish(report *Run_Report, exit_code int) {
+	if run_log == nil {
+		return
+	}
+	defer run_log.file.Close()
+	run_log.mutex.Lock()
+	for _, file := range run_log.artifact_files {
+		file.Close()
+	}
+	run_log.mutex.Unlock()
+	lgr := itlog.New(run_log.file, itlog.LevelInfo)
+	counts := report.counts()
+	report.mutex.Lock()
+	for _, entry := range report.Entries {
+		if entry.Outcome == outcome_unchanged {
+			continue
+		}
+		lgr.Info().
+			Str("kind", entry.Kind).
+			Str("name", entry.Name).
+			Str("outcome", entry.Outcome).
+			Str("reason", entry.Reason).
+			Msg("outcome")
+	}
+	report.mutex.Unlock()
+	lgr.Info().
+		Int("exit_code", exit_code).
+		Int("installed", counts[outcome_installed]).
+		Int("upgraded", counts[outcome_upgraded]).
+		Int("removed", counts[outcome_removed]).
+		Int("failed", counts[outcome_failed]).
+		Int64("duration_ms", time.Since(run_log.start).Milliseconds()).
+		Msg("run finished")
+}
+
+type Run_Summary struct {
+	Id      string
+	Path    string
+	Start   time.Time
+	Command string
+	// False if the run was killed before it could write its report.
+	Finished  bool
+	Exit_Code int
+	Changed   int
+	Failed    int
+	Duration  time.Duration
+}
+
+// Sorted newest first. Files that don't look like run logs are ignored.
+func list_run_logs() (runs []Run_Summary, err error) {
+	entries, err := os.ReadDir(run_log_dir())
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".log")
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		start, err := parse_run_id(id)
+		if err != nil {
+			continue
+		}
+		runs = append(runs, Run_Summary{Id: id, Path: filepath.Join(run_log_dir(), entry.Name()), Start: start})
+	}
+	slices.SortFunc(runs, func(a, b Run_Summary) int { return b.Start.Compare(a.Start) })
+	return runs, nil
+}
+
+// Returns the value of key in an itlog line or "" if it isn't there.
+func log_field(line, key string) string {
+	_, after, ok := strings.Cut(line, "|"+key+"=")
+	if !ok {
+		return ""
+	}
+	value, _, _ := strings.Cut(after, "|")
+	return strings.Trim(value, `"`)
+}
+
+// The messages history looks for don't contain the delimiter, see log_level.
+func log_message(line string) string {
+	fields := strings.SplitN(line, "|", 4)
+	if len(fields) < 3 {
+		return ""
+	}
+	return strings.TrimSpace(fields[2])
+}
+
+func (run *Run_Summary) read() error {
+	contents, err := os.ReadFile(run.Path)
+	if err != nil {
+		return err
+	}
+	for line := range strings.Lines(string(contents)) {
+		switch log_message(line) {
+		case "run started":
+			run.Command = log_field(line, "command")
+		case "run finished":
+			run.Finished = true
+			run.Exit_Code, _ = strconv.Atoi(log_field(line, "exit_code"))
+			installed, _ := strconv.Atoi(log_field(line, "installed"))
+			upgraded, _ := strconv.Atoi(log_field(line, "upgraded"))
+			removed, _ := strconv.Atoi(log_field(line, "removed"))
+			run.Changed = installed + upgraded + removed
+			run.Failed, _ = strconv.Atoi(log_field(line, "failed"))
+			duration_ms, _ := strconv.ParseInt(log_field(line, "duration_ms"), 10, 64)
+			run.Duration = time.Duration(duration_ms) * time.Millisecond
+		}
+	}
+	return nil
+}
+
+func command_history(lgr *itlog.Logger, arguments []string) (exit_code int) {
+	if len(arguments) > 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+	runs, err := list_run_logs()
+	if err != nil {
+		lgr.Error(err).Str("directory", run_log_dir()).Msg("listing run logs")
+		return exit_failure
+	}
+	if len(arguments) == 1 {
+		// A prefix such as 2025-06-10 prints every run from that day, oldest first.
+		slices.Reverse(runs)
+		found := false
+		for _, run := range runs {
+			if !strings.HasPrefix(run.Id, arguments[0]) {
+				continue
+			}
+			found = true
+			contents, err := os.ReadFile(run.Path)
+			if err != nil {
+				lgr.Error(err).Str("file", run.Path).Msg("reading run log")
+				return exit_failure
+			}
+			fmt.Printf("=== %s ===\n", run.Id)
+			os.Stdout.Write(contents)
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "no run matches %q\n", arguments[0])
+			return exit_failure
+		}
+		return exit_ok
+	}
+	if len(runs) == 0 {
+		fmt.Println("no runs recorded yet")
+		return exit_ok
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "RUN\tCOMMAND\tOUTCOME\tCHANGED\tFAILED\tDURATION")
+	for _, run := range runs {
+		if err := run.read(); err != nil {
+			lgr.Warn().Err(err).Str("file", run.Path).Msg("reading run log")
+			continue
+		}
+		outcome := "ok"
+		if !run.Finished {
+			outcome = "interrupted"
+		} else if run.Exit_Code != exit_ok {
+			outcome = "failed"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%d\t%s\n",
+			run.Id, cmp.Or(run.Command, "-"), outcome, run.Changed, run.Failed, run.Duration.Round(time.Second),
+		)
+	}
+	table.Flush()
+	return exit_ok
+}
+
+type Drift struct {
+	// One of modified, replaced, deleted, or added.
+	Kind string
+	// Empty for added files since nothing claims them.
+	Artifact string
+	Path     string
+}
+
+// Compares BIG_BANG_BIN and the BIG_BANG_SHARE/<name> trees of recorded artifacts against the hashes taken at install
+// time. A file is "replaced" when its type changed (e.g. a binary swapped for a symlink) and "modified" when only its
+// contents did. Files a manifest artifact would install aren't "added" even without a record, since artifacts that were
+// installed before the state file existed stay healthy and are never reinstalled to record them.
+func detect_drift(state *State, artifacts map[string]Artifact) (drifts []Drift, err error) {
+	expected := manifest_owned_paths(artifacts)
+	owners := make(map[string]string)
+	scan_roots := []string{BIG_BANG_BIN}
+	for name, record := range state.Artifacts {
+		for _, file := range record.Files {
+			owners[file.Path] = name
+			if tree, ok := share_tree_of(file.Path); ok && !slices.Contains(scan_roots, tree) {
+				scan_roots = append(scan_roots, tree)
+			}
+		}
+		for _, file := range record.Files {
+			info, err := os.Lstat(file.Path)
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				drifts = append(drifts, Drift{Kind: "deleted", Artifact: name, Path: file.Path})
+				continue
+			case err != nil:
+				return nil, err
+			}
+			is_symlink := info.Mode()&fs.ModeSymlink != 0
+			if is_symlink != (file.Symlink != "") || (!is_symlink && !info.Mode().IsRegular()) {
+				drifts = append(drifts, Drift{Kind: "replaced", Artifact: name, Path: file.Path})
+				continue
+			}
+			actual, err := hash_installed_file(file.Path)
+			if err != nil {
+				return nil, err
+			}
+			if is_symlink && actual.Symlink != file.Symlink {
+				drifts = append(drifts, Drift{Kind: "replaced", Artifact: name, Path: file.Path})
+			} else if !is_symlink && actual.Sha256 != file.Sha256 {
+				drifts = append(drifts, Drift{Kind: "modified", Artifact: name, Path: file.Path})
+			}
+		}
+	}
+	for _, root := range scan_roots {
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			if _, ok := owners[path]; !ok && !expected[path] {
+				drifts = append(drifts, Drift{Kind: "added", Path: path})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	slices.SortFunc(drifts, func(a, b Drift) int { return strings.Compare(a.Path, b.Path) })
+	return drifts, nil
+}
+
+// Only removes files whose contents still match what was recorded at install time. Anything else was not created by
+// big_bang, or was changed since, and is left in place along with its record.
+func command_uninstall(state *State, lgr *itlog.Logger, arguments []string) (exit_code int) {
+	flags := flag.NewFlagSet("uninstall", flag.ContinueOnError)
+	purge := flags.Bool("purge", false, "also drop cached downloads")
+	positional, err := parse_flags(flags, arguments)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+	name := positional[0]
+	lgr = lgr.WithStr("artifact", name)
+	record, ok := state.Artifacts[name]
+	if !ok {
+		if artifact, ok := artifact_manifest()[name]; ok && artifact.Install != nil {
+			lgr.Error().Msg("artifact is installed by a custom install step whose files aren't recorded. uninstall it with its own tooling")
+			return exit_failure
+		}
+		lgr.Error().Msg("artifact has no install record. refusing to guess which files are its own")
+		return exit_failure
+	}
+
+	lgr.Info().Begin("uninstalling")
+	remaining, err := remove_recorded_files(record.Files, lgr)
+	if err != nil {
+		lgr.Error(err).Msg("uninstalling")
+		return exit_failure
+	}
+	if len(remaining) == 0 {
+		delete(state.Artifacts, name)
+	} else {
+		record.Files = remaining
+		state.Artifacts[name] = record
+	}
+	if *purge {
+		if err := os.RemoveAll(download_cache_dir(name)); err != nil {
+			lgr.Error(err).Msg("purging cached downloads")
+			return exit_failure
+		}
+	}
+	if err := state.save(); err != nil {
+		lgr.Error(err).Str("file", state_file_path()).Msg("saving installed state")
+		return exit_failure
+	}
+	if _, ok := artifact_manifest()[name]; ok {
+		lgr.Warn().Msg("artifact is still in the manifest and will be reinstalled on the next run")
+	}
+	if len(remaining) > 0 {
+		lgr.Warn().Int("kept", len(remaining)).Msg("some files changed since install and were kept")
+		return exit_failure
+	}
+	lgr.Info().Done("uninstalling")
+	return exit_ok
+}
+
+// Returns the files that were kept because they no longer match their record. Files that are already gone count as
+// removed. Directories left empty inside BIG_BANG_SHARE are removed too.
+func remove_recorded_files(files []Installed_File, lgr *itlog.Logger) (remaining []Installed_File, err error) {
+	for _, file := range files {
+		invariant.Always(filepath.IsAbs(file.Path), "Recorded paths are absolute")
+		actual, err := hash_installed_file(file.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if actual != file {
+			lgr.Warn().Str("file", file.Path).Msg("not removing file that changed since install")
+			remaining = append(remaining, file)
+			continue
+		}
+		if err := os.Remove(file.Path); err != nil {
+			return nil, err
+		}
+		if tree, ok := share_tree_of(file.Path); ok {
+			for dir := filepath.Dir(file.Path); strings.HasPrefix(dir, tree); dir = filepath.Dir(dir) {
+				if os.Remove(dir) != nil {
+					break
+				}
+			}
+		}
+	}
+	return remaining, nil
+}
+
+// Used when `which` finds a copy of a managed executable outside of BIG_BANG_DATA_DIR first.
+func not_managed_error(name, path string) error {
+	return fmt.Errorf("%s resolves to %s which is not inside BIG_BANG_DATA_DIR. run `env doctor` to see why", name, path)
+}
+
+// The executables an artifact puts in BIG_BANG_BIN. Custom installers decide where their executables go so they have none.
+func (artifact *Artifact) executables() []string {
+	switch {
+	case artifact.Install != nil:
+		return nil
+	case artifact.Git_Build != nil:
+		var executables []string
+		for _, binary := range artifact.Git_Build.Binaries {
+			executables = append(executables, filepath.Base(binary))
+		}
+		return executables
+	case artifact.Cargo_Install != nil:
+		return artifact.Cargo_Install.binaries(artifact.Name)
+	default:
+		return []string{artifact.Name}
+	}
+}
+
+type Diagnosis struct {
+	Check   string
+	Problem bool
+	Detail  string
+}
+
+func command_env_doctor(lgr *itlog.Logger) (exit_code int) {
+	var diagnoses []Diagnosis
+	ok := func(check, format string, a ...any) {
+		diagnoses = append(diagnoses, Diagnosis{Check: check, Detail: fmt.Sprintf(format, a...)})
+	}
+	problem := func(check, format string, a ...any) {
+		diagnoses = append(diagnoses, Diagnosis{Check: check, Problem: true, Detail: fmt.Sprintf(format, a...)})
+	}
+	system_dirs := []string{"/bin", "/sbin", "/usr/bin", "/usr/sbin", "/usr/local/bin", "/opt/homebrew/bin"}
+
+	// === Environment ===
+	problems := environment_problems()
+	for _, description := range problems {
+		problem("environment", "%s", description)
+	}
+	if len(problems) == 0 {
+		ok("environment", "PATH is absolute and the BIG_BANG directories exist")
+	}
+
+	// === PATH ===
+	seen := make(map[string]bool)
+	for _, entry := range PATH {
+		if seen[entry] {
+			problem("PATH", "%s is listed more than once", entry)
+		}
+		seen[entry] = true
+		if !dir_exists(entry) {
+			problem("PATH", "%s does not exist", entry)
+		}
+	}
+	bin_index := slices.Index(PATH, BIG_BANG_BIN)
+	if bin_index == -1 {
+		problem("PATH", "BIG_BANG_BIN (%s) is not in PATH", BIG_BANG_BIN)
+	} else {
+		first_system_index := slices.IndexFunc(PATH, func(entry string) bool { return slices.Contains(system_dirs, entry) })
+		if first_system_index != -1 && first_system_index < bin_index {
+			problem("PATH", "BIG_BANG_BIN comes after system directory %s", PATH[first_system_index])
+		} else {
+			ok("PATH", "BIG_BANG_BIN is entry %d of %d, before any system directory", bin_index+1, len(PATH))
+		}
+	}
+
+	// === MANPATH ===
+	manpath := filepath.SplitList(os.Getenv("MANPATH"))
+	switch {
+	case len(manpath) == 0:
+		problem("MANPATH", "MANPATH is unset so BIG_BANG_MAN (%s) is not searched", BIG_BANG_MAN)
+	case !slices.Contains(manpath, BIG_BANG_MAN) && !slices.Contains(manpath, BIG_BANG_MAN+"/"):
+		problem("MANPATH", "BIG_BANG_MAN (%s) is not in MANPATH", BIG_BANG_MAN)
+	default:
+		ok("MANPATH", "BIG_BANG_MAN is in MANPATH")
+		if !slices.Contains(manpath, "") {
+			problem("MANPATH", "MANPATH has no empty entry so the system man pages are not searched")
+		}
+	}
+	manpath_seen := make(map[string]bool)
+	for _, entry := range manpath {
+		if entry == "" {
+			continue
+		}
+		if manpath_seen[entry] {
+			problem("MANPATH", "%s is listed more than once", entry)
+		}
+		manpath_seen[entry] = true
+		if !dir_exists(entry) {
+			problem("MANPATH", "%s does not exist", entry)
+		}
+	}
+
+	// === Shadowing ===
+	artifacts := artifact_manifest()
+	names := slices.Sorted(maps.Keys(artifacts))
+	for _, name := range names {
+		artifact := artifacts[name]
+		for _, executable := range artifact.executables() {
+			var copies []string
+			for _, entry := range PATH {
+				candidate := filepath.Join(entry, executable)
+				if info, err := os.Stat(candidate); err == nil && !info.IsDir() && info.Mode()&0o111 != 0 && !slices.Contains(copies, candidate) {
+					copies = append(copies, candidate)
+				}
+			}
+			switch {
+			case len(copies) == 0:
+				problem("shadowing", "%s is not installed or not on PATH", executable)
+			case !strings.HasPrefix(copies[0], BIG_BANG_DATA_DIR):
+				problem("shadowing", "%s resolves to %s which shadows the managed copy", executable, copies[0])
+			default:
+				ok("shadowing", "%s resolves to %s", executable, copies[0])
+				for _, shadowed := range copies[1:] {
+					ok("shadowing", "%s shadows %s", copies[0], shadowed)
+				}
+			}
+		}
+	}
+
+	// === Toolchain directories ===
+	for _, toolchain_dir := range []struct{ name, path string }{
+		{"CARGO_HOME", CARGO_HOME},
+		{"RUSTUP_HOME", RUSTUP_HOME},
+		{"GOPATH", GOPATH},
+	} {
+		switch {
+		case !filepath.IsAbs(toolchain_dir.path):
+			problem("toolchains", "%s is not set to an absolute path", toolchain_dir.name)
+		case !path_is_within(BIG_BANG_SHARE, toolchain_dir.path):
+			problem("toolchains", "%s=%s is not inside BIG_BANG_SHARE", toolchain_dir.name, toolchain_dir.path)
+		default:
+			ok("toolchains", "%s is inside BIG_BANG_SHARE", toolchain_dir.name)
+		}
+	}
+
+	exit_code = exit_ok
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "STATUS\tCHECK\tDETAIL")
+	for _, diagnosis := range diagnoses {
+		status := "ok"
+		if diagnosis.Problem {
+			status = "problem"
+			exit_code = exit_failure
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", status, diagnosis.Check, diagnosis.Detail)
+	}
+	table.Flush()
+	if exit_code != exit_ok {
+		lgr.Warn().Msg("environment has problems")
+	}
+	return exit_code
+}
+
+// The paths in BIG_BANG_BIN, BIG_BANG_SHARE, and BIG_BANG_MAN that the artifacts in the manifest install to, whether or not they have a
+// record.
+func manifest_owned_paths(artifacts map[string]Artifact) (owned map[string]bool) {
+	owned = make(map[string]bool)
+	for name, artifact := range artifacts {
+		owned[filepath.Join(BIG_BANG_BIN, name)] = true
+		owned[filepath.Join(BIG_BANG_SHARE, name)] = true
+		for _, page := range artifact.Man_Pages {
+			owned[man_page_destination(page)] = true
+		}
+		if artifact.Git_Build != nil {
+			for _, binary := range artifact.Git_Build.Binaries {
+				owned[filepath.Join(BIG_BANG_BIN, filepath.Base(binary))] = true
+			}
+		}
+		if artifact.Cargo_Install != nil {
+			owned[cargo_install_root(name)] = true
+			for _, binary := range artifact.Cargo_Install.binaries(name) {
+				owned[filepath.Join(BIG_BANG_BIN, binary)] = true
+			}
+		}
+	}
+	return owned
+}
+
+type Orphan struct {
+	Path string
+	Size int64
+	// Set if the orphan was recorded for an artifact that is no longer in the manifest. Only its recorded files are removed.
+	Record string
+}
+
+// Orphans are install records of artifacts that are no longer in the manifest, and entries in BIG_BANG_BIN,
+// BIG_BANG_SHARE, and BIG_BANG_MAN that no artifact in the manifest owns. Toolchain directories that big_bang doesn't
+// install itself (CARGO_HOME, RUSTUP_HOME, GOPATH, and the Go installation from bootstrap.lua) are never considered
+// unless a record claims files inside them.
+func find_orphans(state *State, artifacts map[string]Artifact) (orphans []Orphan, err error) {
+	owned := manifest_owned_paths(artifacts)
+	for name, record := range state.Artifacts {
+		if _, ok := artifacts[name]; ok {
+			for _, file := range record.Files {
+				owned[file.Path] = true
+			}
+			continue
+		}
+		var size int64
+		for _, file := range record.Files {
+			if info, err := os.Lstat(file.Path); err == nil {
+				size += info.Size()
+			}
+			owned[file.Path] = true
+		}
+		orphans = append(orphans, Orphan{Path: name + " (install record)", Size: size, Record: name})
+	}
+
+	protected := []string{CARGO_HOME, RUSTUP_HOME, GOPATH, filepath.Join(BIG_BANG_SHARE, "go")}
+	is_protected := func(path string) bool {
+		for _, protected_path := range protected {
+			if !filepath.IsAbs(protected_path) {
+				continue
+			}
+			if path_is_within(protected_path, path) || path_is_within(path, protected_path) {
+				return true
+			}
+		}
+		return false
+	}
+	contains_owned := func(path string) bool {
+		for owned_path := range owned {
+			if path_is_within(owned_path, path) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, root := range []string{BIG_BANG_BIN, BIG_BANG_SHARE, cargo_installs_dir()} {
+		entries, err := os.ReadDir(root)
+		if errors.Is(err, fs.ErrNotExist) && root == cargo_installs_dir() {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			path := filepath.Join(root, entry.Name())
+			// Its install roots are looked at one by one.
+			if path == cargo_installs_dir() {
+				continue
+			}
+			if owned[path] || is_protected(path) || contains_owned(path) {
+				continue
+			}
+			size, err := disk_usage(path)
+			if err != nil {
+				return nil, err
+			}
+			orphans = append(orphans, Orphan{Path: path, Size: size})
+		}
+	}
+	// Man pages are nested in section directories so they are compared file by file.
+	if err := filepath.WalkDir(BIG_BANG_MAN, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || owned[path] {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		orphans = append(orphans, Orphan{Path: path, Size: info.Size()})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(orphans, func(a, b Orphan) int { return strings.Compare(a.Path, b.Path) })
+	return orphans, nil
+}
+
+func command_gc(state *State, lgr *itlog.Logger, arguments []string) (exit_code int) {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "delete without asking for confirmation")
+	positional, err := parse_flags(flags, arguments)
+	if err != nil || len(positional) != 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+	orphans, err := find_orphans(state, artifact_manifest())
+	if err != nil {
+		lgr.Error(err).Msg("finding orphans")
+		return exit_failure
+	}
+	if len(orphans) == 0 {
+		fmt.Println("no orphans found")
+		return exit_ok
+	}
+	var total int64
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "SIZE\tPATH")
+	for _, orphan := range orphans {
+		total += orphan.Size
+		fmt.Fprintf(table, "%s\t%s\n", format_bytes(orphan.Size), orphan.Path)
+	}
+	table.Flush()
+	if !*yes && !confirm(fmt.Sprintf("delete %d orphans (%s)?", len(orphans), format_bytes(total))) {
+		return exit_ok
+	}
+
+	lgr.Info().Begin("collecting garbage")
+	for _, orphan := range orphans {
+		if orphan.Record != "" {
+			remaining, err := remove_recorded_files(state.Artifacts[orphan.Record].Files, lgr)
+			if err != nil {
+				lgr.Error(err).Str("artifact", orphan.Record).Msg("removing recorded files")
+				return exit_failure
+			}
+			if len(remaining) == 0 {
+				delete(state.Artifacts, orphan.Record)
+			} else {
+				record := state.Artifacts[orphan.Record]
+				record.Files = remaining
+				state.Artifacts[orphan.Record] = record
+			}
+			continue
+		}
+		if err := os.RemoveAll(orphan.Path); err != nil {
+			lgr.Error(err).Str("path", orphan.Path).Msg("removing orphan")
+			return exit_failure
+		}
+	}
+	if err := state.save(); err != nil {
+		lgr.Error(err).Str("file", state_file_path()).Msg("saving installed state")
+		return exit_failure
+	}
+	lgr.Info().Done("collecting garbage")
+	return exit_ok
+}
+
+// Asks a yes/no question on stdin. Anything other than y or yes is a no, including a closed stdin.
+// Shared by every prompt. A reader per prompt would drop whatever it buffered past the answer, such as the next answers
+// when they're piped in.
+var stdin = bufio.NewReader(os.Stdin)
+
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := stdin.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// Reports whether path is parent or a descendant of parent.
+func path_is_within(parent, path string) bool {
+	relative, err := filepath.Rel(parent, path)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// The apparent size of a file or directory tree. Symlinks are not followed.
+func disk_usage(path string) (size int64, err error) {
+	err = filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func format_bytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	value := float64(size)
+	suffix := 0
+	for value >= unit && suffix < 4 {
+		value /= unit
+		suffix++
+	}
+	return fmt.Sprintf("%.1f%ciB", value, " KMGT"[suffix])
+}
+
+// The flag package stops at the first positional argument. This lets flags and positional arguments be interleaved.
+func parse_flags(flags *flag.FlagSet, arguments []string) (positional []string, err error) {
+	flags.SetOutput(io.Discard)
+	for {
+		if err := flags.Parse(arguments); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		arguments = flags.Args()[1:]
+	}
+}
+
+// Returns BIG_BANG_SHARE/<name>, or the cargo install root, if path is inside it.
+func share_tree_of(path string) (tree string, ok bool) {
+	parent := BIG_BANG_SHARE
+	if path_is_within(cargo_installs_dir(), path) {
+		parent = cargo_installs_dir()
+	}
+	relative, err := filepath.Rel(parent, path)
+	if err != nil || relative == "." || strings.HasPrefix(relative, "..") {
+		return "", false
+	}
+	first, _, _ := strings.Cut(relative, string(filepath.Separator))
+	return filepath.Join(parent, first), true
+}
+
+func command_verify(state *State, lgr *itlog.Logger) (exit_code int) {
+	drifts, err := detect_drift(state, artifact_manifest())
+	if err != nil {
+		lgr.Error(err).Msg("verifying installed files")
+		return exit_failure
+	}
+	if len(drifts) == 0 {
+		fmt.Println("all installed files match their recorded hashes")
+		return exit_ok
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "STATUS\tARTIFACT\tPATH")
+	for _, drift := range drifts {
+		artifact := drift.Artifact
+		if artifact == "" {
+			artifact = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", drift.Kind, artifact, drift.Path)
+	}
+	table.Flush()
+	return exit_failure
+}
+
+// === Dotfile layers ===
+
+type Dotfile_Layer struct {
+	// Relative to the dotfiles directory, e.g. hosts/<hostname>.
+	Name string
+	Dir  string
+}
+
+// Later layers override earlier ones file by file:
+//
+//	common, the OS (macos or linux), the distros the one in use derives from (ID_LIKE in /etc/os-release, most distant
+//	first), the distro (ID), hosts/<hostname>, then profiles/<name> for each comma-separated name in BIG_BANG_PROFILES.
+//
+// So on Ubuntu, whose ID_LIKE is debian, the debian layer applies before an ubuntu one.
+//
+// Layers without a directory are included so explain can show what could have provided a file.
+func dotfile_layers() (layers []Dotfile_Layer) {
+	names := []string{"common"}
+	switch runtime.GOOS {
+	case "darwin":
+		names = append(names, "macos")
+	case "linux":
+		names = append(names, "linux")
+		// ID_LIKE lists the closest relative first.
+		for _, like := range slices.Backward(strings.Fields(os_release_field("ID_LIKE"))) {
+			names = append(names, like)
+		}
+		if distro := os_release_field("ID"); distro != "" {
+			names = append(names, distro)
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		// macOS appends .local to the hostname.
+		hostname, _, _ = strings.Cut(hostname, ".")
+		names = append(names, filepath.Join("hosts", strings.ToLower(hostname)))
+	}
+	profiles, err := parse_profiles(os.Getenv("BIG_BANG_PROFILES"))
+	invariant.Always(err == nil, "BIG_BANG_PROFILES is validated during setup")
+	for _, profile := range profiles {
+		names = append(names, filepath.Join("profiles", profile))
+	}
+	for _, name := range names {
+		layers = append(layers, Dotfile_Layer{Name: name, Dir: filepath.Join(big_bang_dotfiles_root, name)})
+	}
+	return layers
+}
+
+// Profiles name a directory under dotfiles/profiles/ so they can't climb out of it.
+func parse_profiles(raw string) (profiles []string, err error) {
+	for profile := range strings.SplitSeq(raw, ",") {
+		profile = strings.TrimSpace(profile)
+		if profile == "" {
+			continue
+		}
+		if profile == "." || profile == ".." || strings.ContainsAny(profile, `/\`) {
+			return nil, fmt.Errorf("BIG_BANG_PROFILES entry %q is not a directory name", profile)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// Returns the lowercased value of key or "" if it isn't set.
+// https://www.freedesktop.org/software/systemd/man/latest/os-release.html
+func os_release_field(key string) string {
+	contents, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		contents, err = os.ReadFile("/usr/lib/os-release")
+		if err != nil {
+			return ""
+		}
+	}
+	for line := range strings.Lines(string(contents)) {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), key+"="); ok {
+			return strings.ToLower(strings.Trim(value, `"'`))
+		}
+	}
+	return ""
+}
+
+type Dotfile_Source struct {
+	// The repo file that wins.
+	Path  string
+	Layer string
+	// Earlier layers that have the same file, in order.
+	Overrides []string
+}
+
+// Every layer in the repo, whether or not it applies to this machine. These are the directories in the dotfiles directory
+// and the ones in hosts/ and profiles/.
+func repo_dotfile_layers() (layers []Dotfile_Layer, err error) {
+	entries, err := os.ReadDir(big_bang_dotfiles_root)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if entry.Name() != "hosts" && entry.Name() != "profiles" {
+			layers = append(layers, Dotfile_Layer{Name: entry.Name(), Dir: filepath.Join(big_bang_dotfiles_root, entry.Name())})
+			continue
+		}
+		nested, err := os.ReadDir(filepath.Join(big_bang_dotfiles_root, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range nested {
+			if layer.IsDir() {
+				name := filepath.Join(entry.Name(), layer.Name())
+				layers = append(layers, Dotfile_Layer{Name: name, Dir: filepath.Join(big_bang_dotfiles_root, name)})
+			}
+		}
+	}
+	return layers, nil
+}
+
+// Maps every destination in HOME to the repo file that provides it. Later layers override earlier ones.
+func collect_dotfiles(layers []Dotfile_Layer) (sources map[string]Dotfile_Source, err error) {
+	invariant.Always(filepath.IsAbs(big_bang_dotfiles_root), "dotfiles path is absolute")
+	sources = make(map[string]Dotfile_Source)
+	for _, layer := range layers {
+		if !dir_exists(layer.Dir) {
+			continue
+		}
+		// The .gitignore files above the layer, e.g. the one at the root of the repo.
+		var patterns []Ignore_Pattern
+		for dir := filepath.Dir(layer.Dir); path_is_within(BIG_BANG_GIT_DIR, dir); dir = filepath.Dir(dir) {
+			more, err := load_ignore_file(filepath.Join(dir, ".gitignore"))
+			if err != nil {
+				return nil, err
+			}
+			patterns = append(more, patterns...)
+		}
+		err := filepath.WalkDir(layer.Dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != layer.Dir && is_ignored(patterns, path, entry.IsDir()) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if entry.IsDir() {
+				// Visited before the files below it so its patterns apply to them.
+				more, err := load_ignore_file(filepath.Join(path, ".gitignore"))
+				if err != nil {
+					return err
+				}
+				patterns = append(patterns, more...)
+				if path == layer.Dir {
+					more, err := load_ignore_file(filepath.Join(path, dotfile_ignore_name))
+					if err != nil {
+						return err
+					}
+					patterns = append(patterns, more...)
+				}
+				return nil
+			}
+			if path == filepath.Join(layer.Dir, dotfile_ignore_name) {
+				return nil
+			}
+			relative, err := filepath.Rel(layer.Dir, path)
+			if err != nil {
+				return err
+			}
+			destination := filepath.Join(HOME, dotfile_destination_name(relative))
+			source := Dotfile_Source{Path: path, Layer: layer.Name}
+			if previous, ok := sources[destination]; ok {
+				if previous.Layer == layer.Name {
+					return fmt.Errorf("%s and %s both provide %s", previous.Path, path, destination)
+				}
+				source.Overrides = append(previous.Overrides, previous.Layer)
+			}
+			sources[destination] = source
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", layer.Name, err)
+		}
+	}
+	return sources, nil
+}
+
+// === Dotfile rules ===
+
+// Settings for dotfiles by glob, one rule per line. Later rules win. The glob is relative to HOME and matches the base
+// name at any depth when it has no slash. ** matches any number of directories, e.g.
+//
+//	# Git only tracks the executable bit.
+//	.config/sway/bin/*   mode=0755
+//	.config/gh/hosts.yml mode=0600
+//	fish_variables       strategy=seed-once
+func dotfile_rules_path() string {
+	return filepath.Join(big_bang_dotfiles_root, ".bigbangrules")
+}
+
+type Dotfile_Rule struct {
+	Pattern string
+	// Zero when the rule doesn't set one.
+	Mode fs.FileMode
+	// Empty when the rule doesn't set one.
+	Strategy string
+	Line     int
+}
+
+// How a dotfile gets into HOME.
+const (
+	// Written with the repo's contents whenever they differ. The default.
+	strategy_copy = "copy"
+	// A symlink to the repo file, for files that programs keep rewriting. Their changes show up in the repo.
+	strategy_symlink = "symlink"
+	// Written only if it doesn't exist, for files that programs keep rewriting but shouldn't be committed back.
+	strategy_seed_once = "seed-once"
+)
+
+func load_dotfile_rules() (rules []Dotfile_Rule, err error) {
+	contents, err := os.ReadFile(dotfile_rules_path())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	line_number := 0
+	for line := range strings.Lines(string(contents)) {
+		line_number++
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rule := Dotfile_Rule{Pattern: strings.TrimPrefix(fields[0], "/"), Line: line_number}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", dotfile_rules_path(), line_number, err)
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("%s:%d: %s sets nothing", dotfile_rules_path(), line_number, rule.Pattern)
+		}
+		for _, setting := range fields[1:] {
+			key, value, _ := strings.Cut(setting, "=")
+			switch key {
+			case "mode":
+				mode, err := strconv.ParseUint(value, 8, 32)
+				if err != nil || mode == 0 || mode > 0o777 {
+					return nil, fmt.Errorf("%s:%d: mode must be octal permissions such as 0644, got %q", dotfile_rules_path(), line_number, value)
+				}
+				rule.Mode = fs.FileMode(mode)
+			case "strategy":
+				if !slices.Contains([]string{strategy_copy, strategy_symlink, strategy_seed_once}, value) {
+					return nil, fmt.Errorf("%s:%d: strategy must be copy, symlink, or seed-once, got %q", dotfile_rules_path(), line_number, value)
+				}
+				rule.Strategy = value
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown setting %q", dotfile_rules_path(), line_number, key)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Every dotfile in a run is matched against the same rules so they're read by the first one.
+var dotfile_rules struct {
+	mutex  sync.Mutex
+	loaded bool
+	rules  []Dotfile_Rule
+	err    error
+}
+
+func cached_dotfile_rules() (rules []Dotfile_Rule, err error) {
+	dotfile_rules.mutex.Lock()
+	defer dotfile_rules.mutex.Unlock()
+	if !dotfile_rules.loaded {
+		dotfile_rules.rules, dotfile_rules.err = load_dotfile_rules()
+		dotfile_rules.loaded = true
+	}
+	return dotfile_rules.rules, dotfile_rules.err
+}
+
+// Matches a slash-separated path relative to HOME against a rule's glob.
+func match_dotfile_glob(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	return match_path_glob(pattern, name)
+}
+
+// Matches slash-separated paths segment by segment with path.Match, where a ** segment matches any number of
+// directories.
+func match_path_glob(pattern, name string) bool {
+	var match func(patterns, names []string) bool
+	match = func(patterns, names []string) bool {
+		if len(patterns) == 0 {
+			return len(names) == 0
+		}
+		if patterns[0] == "**" {
+			for skip := 0; skip <= len(names); skip++ {
+				if match(patterns[1:], names[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		ok, _ := path.Match(patterns[0], names[0])
+		return ok && match(patterns[1:], names[1:])
+	}
+	return match(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// Directories in HOME whose contents are kept private no matter what the repo or the rules say. ssh refuses keys and
+// configs that others can read, and gpg warns about them.
+var sensitive_dotfile_dirs = []string{".ssh", ".gnupg"}
+
+func is_sensitive_dotfile(path string) bool {
+	return slices.ContainsFunc(sensitive_dotfile_dirs, func(dir string) bool {
+		return path_is_within(filepath.Join(HOME, dir), path)
+	})
+}
+
+// The mode a dotfile should have in HOME. It's 0755 if the repo file is executable and 0644 otherwise, unless a rule
+// says otherwise. Group and other permissions are then dropped for secrets and anything in sensitive_dotfile_dirs.
+func dotfile_mode(expect, actual string) (mode fs.FileMode, err error) {
+	info, err := os.Stat(expect)
+	if err != nil {
+		return 0, err
+	}
+	// Git only tracks the executable bit so anything else in the checkout comes from the umask.
+	mode = 0o644
+	if info.Mode().Perm()&0o111 != 0 {
+		mode = 0o755
+	}
+	relative, err := filepath.Rel(HOME, actual)
+	if err != nil {
+		return 0, err
+	}
+	rules, err := cached_dotfile_rules()
+	if err != nil {
+		return 0, err
+	}
+	for _, rule := range rules {
+		if rule.Mode != 0 && match_dotfile_glob(rule.Pattern, filepath.ToSlash(relative)) {
+			mode = rule.Mode
+		}
+	}
+	if strings.HasSuffix(expect, encrypted_suffix) || is_sensitive_dotfile(actual) {
+		mode &^= 0o077
+	}
+	return mode, nil
+}
+
+// One of the strategy_* constants.
+func dotfile_strategy(expect, actual string) (strategy string, err error) {
+	relative, err := filepath.Rel(HOME, actual)
+	if err != nil {
+		return "", err
+	}
+	rules, err := cached_dotfile_rules()
+	if err != nil {
+		return "", err
+	}
+	strategy = strategy_copy
+	for _, rule := range rules {
+		if rule.Strategy != "" && match_dotfile_glob(rule.Pattern, filepath.ToSlash(relative)) {
+			strategy = rule.Strategy
+		}
+	}
+	if strategy == strategy_symlink && dotfile_destination_name(expect) != expect {
+		return "", fmt.Errorf("%s can't be symlinked since its contents are generated. see %s", expect, dotfile_rules_path())
+	}
+	return strategy, nil
+}
+
+// Creates the parents of a dotfile. Directories in sensitive_dotfile_dirs are made 0700 even if they already exist.
+func make_dotfile_dirs(dir string) error {
+	invariant.Always(path_is_within(HOME, dir), "Dotfiles live in HOME")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for ; dir != HOME; dir = filepath.Dir(dir) {
+		if is_sensitive_dotfile(dir) {
+			if err := os.Chmod(dir, 0o700); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// === Ignored dotfiles ===
+
+// Each layer can have one at its top, e.g. dotfiles/debian/.bigbangignore. It's written like a .gitignore whose paths are
+// relative to the layer, and it isn't synced itself.
+const dotfile_ignore_name = ".bigbangignore"
+
+// A line of a .gitignore or a .bigbangignore. See https://git-scm.com/docs/gitignore.
+type Ignore_Pattern struct {
+	// The directory of the file it came from. The glob is relative to it.
+	Dir  string
+	Glob string
+	// Anchored globs only match relative to Dir instead of at any depth.
+	Anchored bool
+	// Re-includes what an earlier pattern excluded.
+	Negate   bool
+	Dir_Only bool
+}
+
+// A missing file has no patterns.
+func load_ignore_file(ignore_file string) (patterns []Ignore_Pattern, err error) {
+	contents, err := os.ReadFile(ignore_file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for line := range strings.Lines(string(contents)) {
+		line = strings.TrimRight(line, "\r\n")
+		// Trailing spaces are ignored unless escaped.
+		if trimmed := strings.TrimRight(line, " "); !strings.HasSuffix(trimmed, "\\") {
+			line = trimmed
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := Ignore_Pattern{Dir: filepath.Dir(ignore_file)}
+		if pattern.Negate = strings.HasPrefix(line, "!"); pattern.Negate {
+			line = line[1:]
+		}
+		if pattern.Dir_Only = strings.HasSuffix(line, "/"); pattern.Dir_Only {
+			line = strings.TrimRight(line, "/")
+		}
+		// A slash anywhere but the end anchors the pattern.
+		pattern.Anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		// path.Match spells negated classes [^...] where gitignore uses [!...].
+		line = strings.ReplaceAll(line, "[!", "[^")
+		line = strings.NewReplacer(`\#`, "#", `\!`, "!", `\ `, " ").Replace(line)
+		if _, err := path.Match(line, ""); err != nil || line == "" {
+			// git skips patterns it can't parse as well.
+			continue
+		}
+		pattern.Glob = line
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// The last pattern that matches decides, like in git. Directories that are ignored aren't walked into, so their files
+// can't be re-included.
+func is_ignored(patterns []Ignore_Pattern, file_path string, is_dir bool) (ignored bool) {
+	for _, pattern := range patterns {
+		if pattern.Dir_Only && !is_dir {
+			continue
+		}
+		relative, err := filepath.Rel(pattern.Dir, file_path)
+		if err != nil || !path_is_within(pattern.Dir, file_path) || relative == "." {
+			continue
+		}
+		relative = filepath.ToSlash(relative)
+		glob := pattern.Glob
+		if !pattern.Anchored {
+			glob = "**/" + glob
+		}
+		if match_path_glob(glob, relative) {
+			ignored = !pattern.Negate
+		}
+	}
+	return ignored
+}
+
+type Sync_List_Entry struct {
+	Path     string `json:"path"`
+	Source   string `json:"source"`
+	Layer    string `json:"layer"`
+	Strategy string `json:"strategy"`
+}
+
+// Prints every dotfile a sync would consider, whether or not it's in sync.
+func command_sync_list(lgr *itlog.Logger, output string) (exit_code int) {
+	sources, err := collect_dotfiles(dotfile_layers())
+	if err != nil {
+		lgr.Error(err).Msg("collecting dotfiles")
+		return exit_failure
+	}
+	var entries []Sync_List_Entry
+	for _, destination := range slices.Sorted(maps.Keys(sources)) {
+		source := sources[destination]
+		strategy, err := dotfile_strategy(source.Path, destination)
+		if err != nil {
+			lgr.Error(err).Str("file", destination).Msg("reading dotfile rules")
+			return exit_failure
+		}
+		entries = append(entries, Sync_List_Entry{Path: destination, Source: source.Path, Layer: source.Layer, Strategy: strategy})
+	}
+	if output == "json" {
+		err := write_json(os.Stdout, struct {
+			Schema_Version int               `json:"schema_version"`
+			Dotfiles       []Sync_List_Entry `json:"dotfiles"`
+		}{json_schema_version, entries})
+		if err != nil {
+			lgr.Error(err).Msg("writing json")
+			return exit_failure
+		}
+		return exit_ok
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PATH\tLAYER\tSTRATEGY\tSOURCE")
+	for _, entry := range entries {
+		source := strings.TrimPrefix(entry.Source, BIG_BANG_GIT_DIR+string(filepath.Separator))
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", display_home_path(entry.Path), entry.Layer, entry.Strategy, source)
+	}
+	table.Flush()
+	return exit_ok
+}
+
+// === Dotfile sources ===
+
+// Repo files with this suffix are rendered with text/template before they're compared or written. See Template_Vars.
+const template_suffix = ".tmpl"
+
+// Repo files with this suffix are decrypted before they're compared or written. See encrypt_dotfile.
+const encrypted_suffix = ".enc"
+
+// The name in HOME of a repo file, which drops suffixes such as template_suffix.
+func dotfile_destination_name(relative string) string {
+	if name, ok := strings.CutSuffix(relative, encrypted_suffix); ok {
+		return name
 	}
+	return strings.TrimSuffix(relative, template_suffix)
+}
 
-	// === Collect ===
-	lgr.Info().Begin("finding mismatches")
-	mismatched_files = make(map[string]string)
-	working_directory := big_bang_dotfiles_os_specific
-	if error_find_mismatches := filepath.WalkDir(working_directory, func(src_path string, src fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		} else if src.IsDir() {
-			return nil
+// The contents a repo file should have in HOME. Everything that compares or writes dotfiles goes through this instead of
+// reading the repo file directly.
+func read_dotfile_source(path string) (contents []byte, err error) {
+	contents, err = os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(path, template_suffix):
+		return render_dotfile_template(path, contents)
+	case strings.HasSuffix(path, encrypted_suffix):
+		return decrypt_dotfile_source(path, contents)
+	}
+	return contents, nil
+}
+
+// Whether the file in HOME already has what the repo file renders to, with the mode from dotfile_mode. See
+// dotfile_strategy for the files that match otherwise.
+func dotfile_matches(expect, actual string) bool {
+	info, err := os.Lstat(actual)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	strategy, err := dotfile_strategy(expect, actual)
+	switch {
+	case err != nil:
+		return false
+	case strategy == strategy_seed_once:
+		return true
+	case strategy == strategy_symlink:
+		target, err := os.Readlink(actual)
+		return err == nil && target == expect
+	case info.Mode()&fs.ModeSymlink != 0:
+		// Left from when the rules symlinked the file. Its mode is the link's, which can pass for the file's.
+		return false
+	}
+	mode, err := dotfile_mode(expect, actual)
+	if err != nil || info.Mode().Perm() != mode {
+		return false
+	}
+	expect_contents, err := read_dotfile_source(expect)
+	if err != nil {
+		// Left to the sync, which reports the error.
+		return false
+	}
+	actual_contents, err := os.ReadFile(actual)
+	return err == nil && bytes.Equal(expect_contents, actual_contents)
+}
+
+// The data of every template. Local holds whatever is in BIG_BANG_DATA_DIR/vars.json, which isn't tracked so it can
+// differ between machines, e.g.
+//
+//	{"git_email": "me@work.example", "font_size": 13}
+//
+// used as {{ .Local.git_email }}. Missing keys are an error rather than an empty string.
+type Template_Vars struct {
+	Hostname          string
+	GOOS              string
+	GOARCH            string
+	Distro            string
+	OS_Release        map[string]string
+	HOME              string
+	BIG_BANG_GIT_DIR  string
+	BIG_BANG_DATA_DIR string
+	BIG_BANG_SHARE    string
+	BIG_BANG_MAN      string
+	BIG_BANG_BIN      string
+	Local             map[string]any
+}
+
+func template_vars_path() string {
+	return filepath.Join(BIG_BANG_DATA_DIR, "vars.json")
+}
+
+func load_template_vars() (vars Template_Vars, err error) {
+	hostname, _ := os.Hostname()
+	hostname, _, _ = strings.Cut(hostname, ".")
+	vars = Template_Vars{
+		Hostname:          hostname,
+		GOOS:              runtime.GOOS,
+		GOARCH:            runtime.GOARCH,
+		Distro:            os_release_field("ID"),
+		OS_Release:        make(map[string]string),
+		HOME:              HOME,
+		BIG_BANG_GIT_DIR:  BIG_BANG_GIT_DIR,
+		BIG_BANG_DATA_DIR: BIG_BANG_DATA_DIR,
+		BIG_BANG_SHARE:    BIG_BANG_SHARE,
+		BIG_BANG_MAN:      BIG_BANG_MAN,
+		BIG_BANG_BIN:      BIG_BANG_BIN,
+		Local:             make(map[string]any),
+	}
+	if contents, err := os.ReadFile("/etc/os-release"); err == nil {
+		for line := range strings.Lines(string(contents)) {
+			if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok && !strings.HasPrefix(key, "#") {
+				vars.OS_Release[key] = strings.Trim(value, `"'`)
+			}
 		}
-		dst_path := swap_old_to_new_base_directory(src_path, working_directory, HOME)
-		mismatched_files[src_path] = dst_path
-		return nil
-	}); error_find_mismatches != nil {
-		lgr.Error(error_find_mismatches).Msg("collecting big bang dotfiles and actual dotfiles (os_specific)")
-		return nil
 	}
-	working_directory = big_bang_dotfiles_common
-	if error_find_mismatches := filepath.WalkDir(working_directory, func(src_path string, src fs.DirEntry, err error) error {
+	contents, err := os.ReadFile(template_vars_path())
+	if errors.Is(err, fs.ErrNotExist) {
+		return vars, nil
+	} else if err != nil {
+		return vars, err
+	}
+	if err := json.Unmarshal(contents, &vars.Local); err != nil {
+		return vars, fmt.Errorf("%s: %w", template_vars_path(), err)
+	}
+	return vars, nil
+}
+
+// Every template in a run renders with the same vars so they're loaded by the first one.
+var template_vars struct {
+	mutex  sync.Mutex
+	loaded bool
+	vars   Template_Vars
+	err    error
+}
+
+func render_dotfile_template(path string, contents []byte) (rendered []byte, err error) {
+	template_vars.mutex.Lock()
+	if !template_vars.loaded {
+		template_vars.vars, template_vars.err = load_template_vars()
+		template_vars.loaded = true
+	}
+	vars, err := template_vars.vars, template_vars.err
+	template_vars.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(path)).Option("missingkey=error").Parse(string(contents))
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, vars); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// === Encrypted dotfiles ===
+
+// The format of a .enc file is this header followed by base64 of salt || nonce || AES-256-GCM ciphertext. The key is
+// derived from a passphrase with PBKDF2-SHA256. The header is authenticated as well so the version can't be swapped.
+const (
+	encrypted_header           = "big_bang encrypted v1\n"
+	encryption_salt_size       = 16
+	encryption_kdf_iterations  = 600_000
+	encryption_base64_line_len = 76
+)
+
+// Holds the passphrase after it's read once, along with the files decrypted with it since every key derivation is
+// deliberately slow.
+var dotfile_secrets struct {
+	mutex      sync.Mutex
+	passphrase string
+	decrypted  map[string][]byte
+}
+
+// BIG_BANG_DATA_DIR/dotfiles.key holds the passphrase. Without it, the passphrase is asked for on the terminal.
+func dotfile_keyfile_path() string {
+	return filepath.Join(BIG_BANG_DATA_DIR, "dotfiles.key")
+}
+
+// Callers hold dotfile_secrets.mutex.
+func dotfile_passphrase(confirm_new bool) (passphrase string, err error) {
+	if dotfile_secrets.passphrase != "" {
+		return dotfile_secrets.passphrase, nil
+	}
+	contents, err := os.ReadFile(dotfile_keyfile_path())
+	switch {
+	case err == nil:
+		// Refused like ssh refuses private keys that others can read, since the passphrase unlocks every secret.
+		info, err := os.Stat(dotfile_keyfile_path())
 		if err != nil {
-			return err
-		} else if src.IsDir() {
-			return nil
+			return "", err
 		}
-		dst_path := swap_old_to_new_base_directory(src_path, working_directory, HOME)
-		if _, ok := mismatched_files[dst_path]; ok {
-			return nil
+		if info.Mode().Perm()&0o077 != 0 {
+			return "", fmt.Errorf("%s is accessible by others (mode %04o). run `chmod 600` on it", dotfile_keyfile_path(), info.Mode().Perm())
+		}
+		passphrase = strings.TrimRight(string(contents), "\r\n")
+	case !errors.Is(err, fs.ErrNotExist):
+		return "", err
+	case !is_terminal(os.Stdin):
+		return "", fmt.Errorf("no passphrase for encrypted dotfiles. put it in %s or run interactively", dotfile_keyfile_path())
+	default:
+		passphrase = read_passphrase("dotfiles passphrase: ")
+		if confirm_new && read_passphrase("again: ") != passphrase {
+			return "", errors.New("passphrases don't match")
+		}
+	}
+	if passphrase == "" {
+		return "", errors.New("empty passphrase")
+	}
+	dotfile_secrets.passphrase = passphrase
+	return passphrase, nil
+}
+
+// Turns off the terminal's echo while reading. If stty isn't around the passphrase is echoed rather than not read.
+func read_passphrase(prompt string) string {
+	fmt.Fprint(os.Stderr, prompt)
+	stty := func(argument string) error {
+		cmd := exec.Command("stty", argument)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	if stty("-echo") == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, _ := stdin.ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
+
+func dotfile_cipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, encryption_kdf_iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypt_dotfile(plaintext []byte, passphrase string) (encrypted []byte, err error) {
+	salt := make([]byte, encryption_salt_size)
+	rand.Read(salt)
+	aead, err := dotfile_cipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	payload := slices.Concat(salt, nonce, aead.Seal(nil, nonce, plaintext, []byte(encrypted_header)))
+	encoded := base64.StdEncoding.EncodeToString(payload)
+	encrypted = []byte(encrypted_header)
+	for line := range slices.Chunk([]byte(encoded), encryption_base64_line_len) {
+		encrypted = append(append(encrypted, line...), '\n')
+	}
+	return encrypted, nil
+}
+
+func decrypt_dotfile(encrypted []byte, passphrase string) (plaintext []byte, err error) {
+	encoded, ok := bytes.CutPrefix(encrypted, []byte(encrypted_header))
+	if !ok {
+		return nil, errors.New("not a big_bang encrypted file or an unsupported version")
+	}
+	payload, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(encoded)), ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < encryption_salt_size {
+		return nil, errors.New("truncated encrypted file")
+	}
+	aead, err := dotfile_cipher(passphrase, payload[:encryption_salt_size])
+	if err != nil {
+		return nil, err
+	}
+	payload = payload[encryption_salt_size:]
+	if len(payload) < aead.NonceSize() {
+		return nil, errors.New("truncated encrypted file")
+	}
+	plaintext, err = aead.Open(nil, payload[:aead.NonceSize()], payload[aead.NonceSize():], []byte(encrypted_header))
+	if err != nil {
+		// Don't wrap the error. It can't say more than this and it mustn't hint at the plaintext.
+		return nil, errors.New("wrong passphrase or corrupted encrypted file")
+	}
+	return plaintext, nil
+}
+
+func decrypt_dotfile_source(path string, encrypted []byte) (plaintext []byte, err error) {
+	dotfile_secrets.mutex.Lock()
+	defer dotfile_secrets.mutex.Unlock()
+	checksum := sha256.Sum256(encrypted)
+	cache_key := path + "\x00" + hex.EncodeToString(checksum[:])
+	if plaintext, ok := dotfile_secrets.decrypted[cache_key]; ok {
+		return plaintext, nil
+	}
+	passphrase, err := dotfile_passphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err = decrypt_dotfile(encrypted, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if dotfile_secrets.decrypted == nil {
+		dotfile_secrets.decrypted = make(map[string][]byte)
+	}
+	dotfile_secrets.decrypted[cache_key] = plaintext
+	return plaintext, nil
+}
+
+// Encrypts a file from HOME into a dotfile layer, e.g. `encrypt ~/.netrc` creates dotfiles/common/.netrc.enc.
+func command_encrypt(lgr *itlog.Logger, arguments []string) (exit_code int) {
+	flags := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	layer := flags.String("layer", "common", "the dotfile layer to add the file to, e.g. macos or hosts/<hostname>")
+	force := flags.Bool("force", false, "replace an existing encrypted file")
+	positional, err := parse_flags(flags, arguments)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+	path := positional[0]
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(invocation_dir, path)
+	}
+	path = filepath.Clean(path)
+	relative, err := filepath.Rel(HOME, path)
+	if err != nil || !path_is_within(HOME, path) || path == HOME {
+		fmt.Fprintf(os.Stderr, "%s is not a file in HOME\n", positional[0])
+		return exit_usage
+	}
+	layer_dir := filepath.Join(big_bang_dotfiles_root, *layer)
+	if !slices.ContainsFunc(dotfile_layers(), func(candidate Dotfile_Layer) bool { return candidate.Dir == layer_dir }) {
+		fmt.Fprintf(os.Stderr, "%s is not one of this machine's dotfile layers. see explain\n", *layer)
+		return exit_usage
+	}
+	destination := filepath.Join(layer_dir, relative+encrypted_suffix)
+	if file_exists(destination) && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists. use --force to replace it\n", destination)
+		return exit_failure
+	}
+	plaintext, err := os.ReadFile(path)
+	if err != nil {
+		lgr.Error(err).Str("file", path).Msg("reading file to encrypt")
+		return exit_failure
+	}
+	dotfile_secrets.mutex.Lock()
+	passphrase, err := dotfile_passphrase(true)
+	dotfile_secrets.mutex.Unlock()
+	if err != nil {
+		lgr.Error(err).Msg("reading passphrase")
+		return exit_failure
+	}
+	encrypted, err := encrypt_dotfile(plaintext, passphrase)
+	if err != nil {
+		lgr.Error(err).Msg("encrypting")
+		return exit_failure
+	}
+	if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+		lgr.Error(err).Str("file", destination).Msg("creating layer directory")
+		return exit_failure
+	}
+	if err := os.WriteFile(destination, encrypted, 0o644); err != nil {
+		lgr.Error(err).Str("file", destination).Msg("writing encrypted file")
+		return exit_failure
+	}
+	fmt.Printf("encrypted %s to %s. don't forget to commit it\n", display_home_path(path), destination)
+	return exit_ok
+}
+
+// Shows which layer provides each of the given HOME paths. A directory explains every file under it.
+func command_explain(lgr *itlog.Logger, arguments []string) (exit_code int) {
+	if len(arguments) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return exit_usage
+	}
+	sources, err := collect_dotfiles(dotfile_layers())
+	if err != nil {
+		lgr.Error(err).Msg("collecting dotfiles")
+		return exit_failure
+	}
+	fmt.Println("layers, later ones win:")
+	for _, layer := range dotfile_layers() {
+		if dir_exists(layer.Dir) {
+			fmt.Println("  " + layer.Name)
+		} else {
+			fmt.Printf("  %s (no such directory)\n", layer.Name)
 		}
-		mismatched_files[src_path] = dst_path
-		return nil
-	}); error_find_mismatches != nil {
-		lgr.Error(error_find_mismatches).Msg("Collecting big bang dotfiles and actual dotfiles (common)")
-		return nil
+	}
+	fmt.Println()
+
+	exit_code = exit_ok
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PATH\tLAYER\tOVERRIDES\tSTATUS")
+	for _, argument := range arguments {
+		path := argument
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(invocation_dir, path)
+		}
+		path = filepath.Clean(path)
+		var destinations []string
+		for destination := range sources {
+			if path_is_within(path, destination) {
+				destinations = append(destinations, destination)
+			}
+		}
+		if len(destinations) == 0 {
+			fmt.Fprintf(table, "%s\t-\t-\tnot provided by any layer\n", display_home_path(path))
+			exit_code = exit_failure
+			continue
+		}
+		slices.Sort(destinations)
+		for _, destination := range destinations {
+			source := sources[destination]
+			overrides := "-"
+			if len(source.Overrides) > 0 {
+				overrides = strings.Join(source.Overrides, ", ")
+			}
+			status := "in sync"
+			if !file_exists(destination) {
+				status = "missing"
+			} else if !dotfile_matches(source.Path, destination) {
+				status = "differs"
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", display_home_path(destination), source.Layer, overrides, status)
+		}
+	}
+	table.Flush()
+	return exit_code
+}
+
+// Map key = repo file; value = corresponding file in HOME.
+// Also returns the files that already match, keyed the same way. ok is false if the dotfiles could not be collected.
+func mismatched_dotfiles(lgr *itlog.Logger) (mismatched_files map[string]string, matched map[string]string, ok bool) {
+	invariant.Always(filepath.IsAbs(big_bang_dotfiles_root), "dotfiles path is absolute")
+	invariant.Always(dir_exists(big_bang_dotfiles_root), "dotfiles directory exists already")
+	defer func() {
+		if len(mismatched_files) > 0 {
+			invariant.Always(func() bool {
+				for file := range mismatched_files {
+					if !filepath.IsAbs(file) {
+						return false
+					}
+				}
+				return true
+			}(), "file path is absolute")
+		}
+	}()
+
+	// === Collect ===
+	lgr.Info().Begin("finding mismatches")
+	defer tracer.span("finding mismatches", "")()
+	sources, err := collect_dotfiles(dotfile_layers())
+	if err != nil {
+		lgr.Error(err).Msg("collecting big bang dotfiles and actual dotfiles")
+		return nil, nil, false
+	}
+	mismatched_files = make(map[string]string, len(sources))
+	for destination, source := range sources {
+		mismatched_files[source.Path] = destination
 	}
 
 	// === Match ===
+	matched = make(map[string]string)
 	for expect, actual := range mismatched_files {
 		invariant.Always(!is_dir(actual), "Actual dotfile is not a directory")
-		if file_contents_are_equal(expect, actual) {
+		if dotfile_matches(expect, actual) {
 			delete(mismatched_files, expect)
+			matched[expect] = actual
 		}
 	}
 	if len(mismatched_files) == 0 {
@@ -641,7 +4809,7 @@ func mismatched_dotfiles(lgr *itlog.Logger) (mismatched_files map[string]string)
 	} else {
 		lgr.Info().Done("finding mismatches (found some)")
 	}
-	return mismatched_files
+	return mismatched_files, matched, true
 }
 
 // You must provide a context.WithTimeout() to set a hard limit on each transfer, which will be reset with every retry.
@@ -654,9 +4822,26 @@ func download_artifact(ctx context.Context, artifact Artifact, output_directory
 	lgr = lgr.WithStr("artifact", artifact.Name)
 	lgr.Info().Begin("downloading")
 	defer lgr.Info().Done("downloading")
+	defer tracer.span("downloading", artifact.Name)()
 	if err := os.MkdirAll(output_directory, 0o755); err != nil {
 		return ""
 	}
+	if cached := filepath.Join(download_cache_dir(artifact.Name), artifact.Checksum); artifact.Checksum != "" && is_dir(cached) {
+		if entries, err := os.ReadDir(cached); err == nil && len(entries) == 1 {
+			cached_path := filepath.Join(cached, entries[0].Name())
+			if hex.EncodeToString(file_checksum(cached_path, lgr)) == artifact.Checksum {
+				download_path = filepath.Join(output_directory, entries[0].Name())
+				if err := copy_file(cached_path, download_path, 0o644); err == nil {
+					lgr.Info().Msg("using cached download")
+					if info, err := os.Stat(download_path); err == nil {
+						events.emit(Event{Type: "download", Name: artifact.Name, Path: download_path, Bytes: info.Size(), Sha256: artifact.Checksum, Cached: true})
+					}
+					return download_path
+				}
+			}
+		}
+		lgr.Warn().Msg("ignoring invalid download cache")
+	}
 	retry_event := lgr.Warn()
 	first_iteration := true
 	for retry_delay_ns := time.Second * 2; ; retry_delay_ns = min(retry_delay_ns*2, time.Minute*10) {
@@ -711,7 +4896,7 @@ func download_artifact(ctx context.Context, artifact Artifact, output_directory
 			continue
 		}
 		download_path = filepath.Clean(filepath.Join(output_directory, filename))
-		response_body, err := io.ReadAll(response.Body)
+		response_body, err := io.ReadAll(progress.reader(artifact.Name, response.Body, response.ContentLength))
 		if err != nil {
 			retry_event.Err(err)
 			continue
@@ -734,13 +4919,53 @@ func download_artifact(ctx context.Context, artifact Artifact, output_directory
 				Msg("unset checksum. copy the calculated checksum and set it in the source code then rerun the script")
 			return ""
 		}
+		events.emit(Event{
+			Type:   "download",
+			Name:   artifact.Name,
+			Path:   download_path,
+			Source: artifact.Download_Link,
+			Bytes:  int64(len(response_body)),
+			Sha256: actual_checksum,
+		})
 		break
 	}
 	invariant.Always(filepath.IsAbs(download_path), "")
+	cached := filepath.Join(download_cache_dir(artifact.Name), artifact.Checksum)
+	if err := os.RemoveAll(cached); err != nil {
+		lgr.Warn().Err(err).Msg("clearing download cache")
+	} else if err := copy_file(download_path, filepath.Join(cached, filepath.Base(download_path)), 0o644); err != nil {
+		lgr.Warn().Err(err).Msg("caching download")
+	}
 	return download_path
 }
 
-func install_artifact(artifact Artifact, artifact_archive_path string, lgr *itlog.Logger) (ok bool) {
+// Verified archives are kept under BIG_BANG_DATA_DIR/cache/<name>/<sha256>/ so that reinstalling doesn't hit the network.
+func download_cache_dir(artifact_name string) string {
+	invariant.Always(artifact_name != "", "")
+	return filepath.Join(BIG_BANG_DATA_DIR, "cache", artifact_name)
+}
+
+// Drops the cached archives of an artifact's other versions once the current one is installed, since they'd never be
+// used again unless the manifest is rolled back.
+func prune_download_cache(artifact Artifact) error {
+	entries, err := os.ReadDir(download_cache_dir(artifact.Name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == artifact.Checksum {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(download_cache_dir(artifact.Name), entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func install_artifact(artifact Artifact, artifact_archive_path string, lgr *itlog.Logger) (installed []string, ok bool) {
 	invariant.Always(artifact.Name != "", "")
 	invariant.Always(filepath.IsAbs(artifact_archive_path), "")
 	invariant.Always(strings.HasPrefix(artifact_archive_path, BIG_BANG_TMP), "")
@@ -748,11 +4973,12 @@ func install_artifact(artifact Artifact, artifact_archive_path string, lgr *itlo
 	lgr = lgr.WithStr("artifact", artifact.Name)
 	lgr.Info().Begin("installing")
 	defer lgr.Info().Done("installing")
+	defer tracer.span("installing", artifact.Name)()
 	artifact_filename := filepath.Base(artifact_archive_path)
 	switch {
 	default:
 		lgr.Error().Str("file", artifact_filename).Msg("unsupported extension")
-		return false
+		return nil, false
 	case strings.HasSuffix(artifact_filename, ".tar.gz"), strings.HasSuffix(artifact_filename, ".tar.xz"):
 		var compression_flag string
 		switch {
@@ -762,16 +4988,16 @@ func install_artifact(artifact Artifact, artifact_archive_path string, lgr *itlo
 			compression_flag = "--xz"
 		default:
 			lgr.Error().Str("file", artifact_filename).Msg("unsupported tar compresison")
-			return false
+			return nil, false
 		}
-		if err := spawn("", nil,
+		if err := spawn(run_log.child_output(artifact.Name), "", nil,
 			"tar",
 			"--extract", compression_flag,
 			"--file", artifact_archive_path,
 			"--directory", filepath.Dir(artifact_archive_path),
 		); err != nil {
 			lgr.Error(err).Msg("unpacking .xz file with external tool")
-			return false
+			return nil, false
 		}
 	case strings.HasSuffix(artifact_filename, ".zip"):
 		unpacking_error := func() error {
@@ -855,43 +5081,294 @@ func install_artifact(artifact Artifact, artifact_archive_path string, lgr *itlo
 		}
 		return ""
 	}
+	var unpacked_dir string
 	artifact_binary_destination := filepath.Join(BIG_BANG_BIN, artifact.Name)
 	if err := os.Remove(artifact_binary_destination); err != nil && !errors.Is(err, fs.ErrNotExist) {
 		lgr.Error(err).Msg("making sure binary destination file doesn't exist yet")
-		return false
+		return nil, false
 	}
 	if artifact.Retain_Installation_Dir {
 		artifact_root_dir := filepath.Join(BIG_BANG_SHARE, artifact.Name)
 		os.RemoveAll(artifact_root_dir)
+		if err := os.Remove(artifact_archive_path); err != nil {
+			lgr.Error(err).Msg("removing archive before finalizing installation")
+			return nil, false
+		}
 		if err := os.Rename(filepath.Dir(artifact_archive_path), artifact_root_dir); err != nil {
 			lgr.Error(err).Msg("finalizing artifact installation")
-			return false
+			return nil, false
 		}
 		artifact_binary_source := find_file(artifact.Name, artifact_root_dir)
-		if !slices.Contains(PATH, artifact_binary_source) {
+		if !slices.Contains(PATH, filepath.Dir(artifact_binary_source)) {
 			lgr.Error().Str("path_to_add", filepath.Dir(artifact_binary_source)).Msg("artifact bin directory has not been added to PATH")
-			return false
+			return nil, false
 		}
 		if err := os.Chmod(artifact_binary_source, 0o755); err != nil {
 			lgr.Error(err).Msg("making artifact binary executable")
-			return false
+			return nil, false
 		}
+		installed = append(installed, artifact_root_dir)
+		unpacked_dir = artifact_root_dir
 	} else {
+		unpacked_dir = filepath.Dir(artifact_archive_path)
 		artifact_binary_source := find_file(artifact.Name, filepath.Dir(artifact_archive_path))
 		if artifact_binary_source == "" {
 			lgr.Error().Msg("binary was not found")
-			return false
+			return nil, false
 		}
 		if err := os.Rename(artifact_binary_source, artifact_binary_destination); err != nil {
 			lgr.Error(err).Str("artifact_binary_source", artifact_binary_source).Msg("moving binary to BIG_BANG_BIN")
-			return false
+			return nil, false
 		}
 		if err := os.Chmod(artifact_binary_destination, 0o755); err != nil {
 			lgr.Error(err).Msg("making artifact binary executable")
-			return false
+			return nil, false
 		}
+		installed = append(installed, artifact_binary_destination)
 	}
-	return true
+	for _, page := range artifact.Man_Pages {
+		source := find_file(page, unpacked_dir)
+		if source == "" {
+			lgr.Error().Str("man_page", page).Msg("declared man page was not found in the archive")
+			return nil, false
+		}
+		destination := man_page_destination(page)
+		if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+			lgr.Error(err).Msg("creating man page section directory")
+			return nil, false
+		}
+		if err := os_remove_if_exists(destination); err != nil {
+			lgr.Error(err).Msg("making sure man page destination file doesn't exist yet")
+			return nil, false
+		}
+		link := os.Rename
+		if artifact.Retain_Installation_Dir {
+			link = os.Symlink
+		}
+		if err := link(source, destination); err != nil {
+			lgr.Error(err).Str("man_page", page).Msg("linking man page into BIG_BANG_MAN")
+			return nil, false
+		}
+		installed = append(installed, destination)
+	}
+	return installed, true
+}
+
+// Matches a man page file name and captures its section number, e.g. "1" for "rg.1" and "3" for "foo.3pm.gz".
+var man_page_pattern = regexp.MustCompile(`^[^/]+\.([1-9])[a-z]*(?:\.gz)?$`)
+
+func man_page_destination(page string) string {
+	match := man_page_pattern.FindStringSubmatch(page)
+	invariant.Always(match != nil, "Man pages are validated with the manifest")
+	return filepath.Join(BIG_BANG_MAN, "man"+match[1], page)
+}
+
+// The repository is cloned into its own directory under BIG_BANG_TMP which is removed afterwards, regardless of the outcome.
+func install_git_build(artifact Artifact, lgr *itlog.Logger) (installed []string, ok bool) {
+	invariant.Always(artifact.Name != "", "")
+	invariant.Always(artifact.Git_Build != nil, "")
+	recipe := artifact.Git_Build
+	lgr = lgr.WithStr("artifact", artifact.Name)
+	output := run_log.child_output(artifact.Name)
+	lgr.Info().Begin("building from source")
+	defer tracer.span("building from source", artifact.Name)()
+	for _, executable := range []string{"git", recipe.Build[0]} {
+		if which(executable) == "" {
+			lgr.Error().Str("executable", executable).Msg("build dependency is not installed")
+			return nil, false
+		}
+	}
+	if len(recipe.Vendor) > 0 && which(recipe.Vendor[0]) == "" {
+		lgr.Error().Str("executable", recipe.Vendor[0]).Msg("vendoring dependency is not installed")
+		return nil, false
+	}
+
+	build_root, err := os.MkdirTemp(BIG_BANG_TMP, artifact.Name+"-git-build-")
+	if err != nil {
+		lgr.Error(err).Msg("creating isolated build directory")
+		return nil, false
+	}
+	defer os.RemoveAll(build_root)
+	clone_dir := filepath.Join(build_root, "src")
+	if err := spawn(output, "", nil,
+		"git", "clone", "--quiet", "--depth=1", "--branch="+recipe.Tag, recipe.Repository, clone_dir,
+	); err != nil {
+		lgr.Error(err).Msg("cloning git repo")
+		return nil, false
+	}
+	actual_commit, err := pipe_strict(context.Background(), "git", "-C", clone_dir, "rev-parse", "HEAD")
+	if err != nil {
+		lgr.Error(err).Msg("resolving cloned commit")
+		return nil, false
+	}
+	if recipe.Commit == "" {
+		lgr.Error().Str("tag", recipe.Tag).Str("actual", actual_commit).
+			Msg("refusing to build an unpinned git tag. check the commit upstream and set it in the source code")
+		return nil, false
+	} else if actual_commit != recipe.Commit {
+		lgr.Error().
+			Str("tag", recipe.Tag).
+			Str("expected", recipe.Commit).
+			Str("actual", actual_commit).
+			Msg("git tag does not resolve to the pinned commit")
+		return nil, false
+	}
+
+	if len(recipe.Vendor) > 0 {
+		if err := spawn(output, clone_dir, recipe.Environment, recipe.Vendor[0], recipe.Vendor[1:]...); err != nil {
+			lgr.Error(err).Msg("vendoring dependencies")
+			return nil, false
+		}
+	}
+	if err := spawn(output, clone_dir, recipe.Environment, recipe.Build[0], recipe.Build[1:]...); err != nil {
+		lgr.Error(err).Msg("building")
+		return nil, false
+	}
+
+	for _, binary := range recipe.Binaries {
+		invariant.Always(!filepath.IsAbs(binary), "Git build binaries are relative to the clone root")
+		source := filepath.Join(clone_dir, filepath.Clean(binary))
+		destination := filepath.Join(BIG_BANG_BIN, filepath.Base(binary))
+		if !file_exists(source) {
+			lgr.Error().Str("binary", binary).Msg("declared binary was not produced by the build")
+			return nil, false
+		}
+		if err := os_remove_if_exists(destination); err != nil {
+			lgr.Error(err).Msg("making sure binary destination file doesn't exist yet")
+			return nil, false
+		}
+		if err := os.Rename(source, destination); err != nil {
+			lgr.Error(err).Str("binary", binary).Msg("moving binary to BIG_BANG_BIN")
+			return nil, false
+		}
+		if err := os.Chmod(destination, 0o755); err != nil {
+			lgr.Error(err).Msg("making artifact binary executable")
+			return nil, false
+		}
+		installed = append(installed, destination)
+	}
+	lgr.Info().Done("building from source")
+	return installed, true
+}
+
+// GOBIN points to a staging directory so that a failed verification never touches BIG_BANG_BIN. GOFLAGS is overridden so
+// that a GOFLAGS from the environment (e.g. -mod=vendor) can't change how the module is resolved. GOPROXY is inherited.
+func install_go_install(artifact Artifact, lgr *itlog.Logger) (installed []string, ok bool) {
+	invariant.Always(artifact.Name != "", "")
+	invariant.Always(artifact.Go_Install != nil, "")
+	recipe := artifact.Go_Install
+	lgr = lgr.WithStr("artifact", artifact.Name)
+	output := run_log.child_output(artifact.Name)
+	lgr.Info().Begin("go installing")
+	defer tracer.span("go installing", artifact.Name)()
+	if which("go") == "" {
+		lgr.Error().Msg("go is not installed")
+		return nil, false
+	}
+	staging_dir, err := os.MkdirTemp(BIG_BANG_TMP, artifact.Name+"-go-install-")
+	if err != nil {
+		lgr.Error(err).Msg("creating staging directory")
+		return nil, false
+	}
+	defer os.RemoveAll(staging_dir)
+	if err := spawn(output, "", []string{"GOBIN=" + staging_dir, "GOFLAGS=-mod=mod"},
+		"go", "install", recipe.Package+"@"+recipe.Version,
+	); err != nil {
+		lgr.Error(err).Msg("go install")
+		return nil, false
+	}
+	source := filepath.Join(staging_dir, artifact.Name)
+	if !file_exists(source) {
+		lgr.Error().Str("package", recipe.Package).Msg("go install did not produce a binary named after the artifact")
+		return nil, false
+	}
+	if err := recipe.matches_build_info(context.Background(), source); err != nil {
+		lgr.Error(err).Msg("verifying build info")
+		return nil, false
+	}
+	destination := filepath.Join(BIG_BANG_BIN, artifact.Name)
+	if err := os_remove_if_exists(destination); err != nil {
+		lgr.Error(err).Msg("making sure binary destination file doesn't exist yet")
+		return nil, false
+	}
+	if err := os.Rename(source, destination); err != nil {
+		lgr.Error(err).Msg("moving binary to BIG_BANG_BIN")
+		return nil, false
+	}
+	lgr.Info().Done("go installing")
+	return []string{destination}, true
+}
+
+// Installs into the artifact's own root then moves the binaries into BIG_BANG_BIN. --force is always passed because cargo
+// would otherwise skip the install when its metadata says the crate is present even though the binaries are gone.
+func install_cargo_install(artifact Artifact, lgr *itlog.Logger) (installed []string, ok bool) {
+	invariant.Always(artifact.Name != "", "")
+	invariant.Always(artifact.Cargo_Install != nil, "")
+	recipe := artifact.Cargo_Install
+	lgr = lgr.WithStr("artifact", artifact.Name)
+	output := run_log.child_output(artifact.Name)
+	lgr.Info().Begin("cargo installing")
+	defer tracer.span("cargo installing", artifact.Name)()
+	if which("cargo") == "" {
+		lgr.Error().Msg("cargo is not installed")
+		return nil, false
+	}
+	arguments := []string{}
+	if recipe.Toolchain != "" {
+		if err := spawn(output, "", nil, "rustup", "toolchain", "install", "--profile=minimal", recipe.Toolchain); err != nil {
+			lgr.Error(err).Str("toolchain", recipe.Toolchain).Msg("installing rust toolchain")
+			return nil, false
+		}
+		arguments = append(arguments, "+"+recipe.Toolchain)
+	}
+	root := cargo_install_root(artifact.Name)
+	target_dir, err := os.MkdirTemp(BIG_BANG_TMP, artifact.Name+"-cargo-install-")
+	if err != nil {
+		lgr.Error(err).Msg("creating isolated target directory")
+		return nil, false
+	}
+	defer os.RemoveAll(target_dir)
+	arguments = append(arguments,
+		"install", "--quiet", "--force",
+		"--root", root,
+		"--target-dir", target_dir,
+		"--version", "="+recipe.Version,
+	)
+	if recipe.Locked {
+		arguments = append(arguments, "--locked")
+	}
+	if len(recipe.Features) > 0 {
+		arguments = append(arguments, "--features", strings.Join(recipe.Features, ","))
+	}
+	arguments = append(arguments, recipe.Crate)
+	if err := spawn(output, "", nil, "cargo", arguments...); err != nil {
+		lgr.Error(err).Msg("cargo install")
+		return nil, false
+	}
+	for _, binary := range recipe.binaries(artifact.Name) {
+		source := filepath.Join(root, "bin", binary)
+		destination := filepath.Join(BIG_BANG_BIN, binary)
+		if !file_exists(source) {
+			lgr.Error().Str("binary", binary).Msg("declared binary was not installed by cargo")
+			return nil, false
+		}
+		if err := os_remove_if_exists(destination); err != nil {
+			lgr.Error(err).Msg("making sure binary destination file doesn't exist yet")
+			return nil, false
+		}
+		if err := os.Rename(source, destination); err != nil {
+			lgr.Error(err).Str("binary", binary).Msg("moving binary to BIG_BANG_BIN")
+			return nil, false
+		}
+		installed = append(installed, destination)
+	}
+	if err := recipe.matches_install_list(context.Background(), root); err != nil {
+		lgr.Error(err).Msg("verifying cargo install metadata")
+		return nil, false
+	}
+	lgr.Info().Done("cargo installing")
+	// The install root only holds cargo's metadata at this point, which the health check depends on.
+	return append(installed, root), true
 }
 
 func file_checksum(source_path string, lgr *itlog.Logger) []byte {
@@ -908,6 +5385,35 @@ func file_checksum(source_path string, lgr *itlog.Logger) []byte {
 	return hasher.Sum(nil)
 }
 
+// Creates the destination's parent directories as needed. An existing destination gets perm as well, before anything is
+// written into it.
+func copy_file(source, destination string, perm fs.FileMode) error {
+	invariant.Always(filepath.IsAbs(source), "")
+	invariant.Always(filepath.IsAbs(destination), "")
+	source_handle, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer source_handle.Close()
+	if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+		return err
+	}
+	destination_handle, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	// OpenFile only applies perm to new files, and the umask may have narrowed it.
+	if err := destination_handle.Chmod(perm); err != nil {
+		destination_handle.Close()
+		return err
+	}
+	if _, err := io.Copy(destination_handle, source_handle); err != nil {
+		destination_handle.Close()
+		return err
+	}
+	return destination_handle.Close()
+}
+
 func os_remove_if_exists(file_path string) error {
 	if err := os.Remove(file_path); !errors.Is(err, fs.ErrNotExist) {
 		return err
@@ -920,11 +5426,44 @@ type Artifact struct {
 	Name          string
 	Download_Link string
 	Checksum      string
-	Version       string
-	Checkhealth   func() error
+	// The expected version as extracted from the version command's output, e.g. "0.11.3" rather than "NVIM v0.11.3".
+	Version string
+	// Defaults to `<Name> --version`.
+	Version_Command []string
+	// Extracts the version from the version command's output. The first capture group is used if there is one, otherwise
+	// the whole match. Defaults to the first semver-looking token.
+	Version_Pattern string
+	// Replaces the exact comparison against Version. Comma separated clauses that must all hold, e.g. ">=0.11, <0.12".
+	// Supported operators are =, !=, >, >=, <, <=.
+	Version_Constraint string
+	// Must respect ctx so that a hung binary can't stall the run. Called concurrently with other artifacts' health checks.
+	Checkhealth func(ctx context.Context) error
 
 	// As much as possible, download artifact binaries directly. If not possible, then specify the custom installation procedure here.
-	Install func(*itlog.Logger)
+	// output receives the output of spawned processes. See Run_Log.child_output.
+	//
+	// What a custom install puts on the machine isn't recorded in the state file since it's up to the installer it runs
+	// (e.g. rustup or Homebrew's install script), which also updates those files on its own. So uninstall refuses these
+	// artifacts and verify doesn't check them. gc leaves them alone as long as their files are under a protected
+	// toolchain directory or named after the artifact.
+	Install func(lgr *itlog.Logger, output io.Writer)
+
+	// Builds the artifact from a pinned git tag when there are no usable binary releases.
+	Git_Build *Git_Build
+
+	// Installs the artifact with `go install`. The health check reads the binary's embedded build info instead of --version.
+	Go_Install *Go_Install
+
+	// Installs a crate with `cargo install`. The health check reads cargo's install metadata instead of --version.
+	Cargo_Install *Cargo_Install
+
+	// File names of man pages in the downloaded archive, e.g. "rg.1". They're found the same way as the binary and end up
+	// in BIG_BANG_MAN/man<section>, symlinked if the installation dir is retained and moved otherwise.
+	Man_Pages []string
+
+	// Artifacts that have to be installed first, e.g. the toolchain a build runs. If one of them fails, this one isn't
+	// attempted.
+	Depends_On []string
 
 	// If false, deletes BIG_BANG_DATA_DIR/<PROGRAM>/ after installation.
 	// Useful for self-contained executables with no other files unlike Golang with its stdlib or nvim with its runtime directories.
@@ -932,6 +5471,638 @@ type Artifact struct {
 	Retain_Installation_Dir bool
 }
 
+var default_version_pattern = regexp.MustCompile(`v?(\d+\.\d+(?:\.\d+)?(?:-[0-9A-Za-z.-]+)?)`)
+
+// The versions in a Version_Constraint, which have to be exactly a version rather than merely contain one.
+var constraint_version_pattern = regexp.MustCompile(`^\d+\.\d+(?:\.\d+)?(?:-[0-9A-Za-z.-]+)?$`)
+
+func (artifact *Artifact) version_command() []string {
+	if len(artifact.Version_Command) == 0 {
+		return []string{artifact.Name, "--version"}
+	}
+	return artifact.Version_Command
+}
+
+func (artifact *Artifact) extract_version(output string) string {
+	pattern := default_version_pattern
+	if artifact.Version_Pattern != "" {
+		pattern = regexp.MustCompile(artifact.Version_Pattern)
+	}
+	match := pattern.FindStringSubmatch(output)
+	switch {
+	case len(match) == 0:
+		return ""
+	case len(match) > 1:
+		return match[1]
+	default:
+		return match[0]
+	}
+}
+
+// Checks the output of the version command against Version_Constraint, or Version if there is no constraint.
+func (artifact *Artifact) check_version(output string) error {
+	actual := artifact.extract_version(output)
+	if actual == "" {
+		return fmt.Errorf("%s version could not be extracted from %q", artifact.Name, output)
+	}
+	if artifact.Version_Constraint == "" {
+		if actual != artifact.Version {
+			return fmt.Errorf("%s is wrong version. expected %q. got %q", artifact.Name, artifact.Version, actual)
+		}
+		return nil
+	}
+	constraint, err := parse_version_constraint(artifact.Version_Constraint)
+	invariant.Always(err == nil, "Version constraints were validated")
+	if !constraint.allows(actual) {
+		return fmt.Errorf("%s is wrong version. expected %q. got %q", artifact.Name, artifact.Version_Constraint, actual)
+	}
+	return nil
+}
+
+type Version_Clause struct {
+	Operator string
+	Version  string
+}
+
+type Version_Constraint []Version_Clause
+
+func parse_version_constraint(raw string) (constraint Version_Constraint, err error) {
+	for clause := range strings.SplitSeq(raw, ",") {
+		clause = strings.TrimSpace(clause)
+		operator := "="
+		for _, candidate := range []string{">=", "<=", "!=", "==", ">", "<", "="} {
+			if strings.HasPrefix(clause, candidate) {
+				operator = candidate
+				clause = strings.TrimSpace(strings.TrimPrefix(clause, candidate))
+				break
+			}
+		}
+		if operator == "==" {
+			operator = "="
+		}
+		clause = strings.TrimPrefix(clause, "v")
+		if !constraint_version_pattern.MatchString(clause) {
+			return nil, fmt.Errorf("invalid version constraint clause %q", raw)
+		}
+		constraint = append(constraint, Version_Clause{Operator: operator, Version: clause})
+	}
+	return constraint, nil
+}
+
+func (constraint Version_Constraint) allows(version string) bool {
+	version = strings.TrimPrefix(version, "v")
+	for _, clause := range constraint {
+		order := compare_versions(version, clause.Version)
+		var ok bool
+		switch clause.Operator {
+		case "=":
+			ok = order == 0
+		case "!=":
+			ok = order != 0
+		case ">":
+			ok = order > 0
+		case ">=":
+			ok = order >= 0
+		case "<":
+			ok = order < 0
+		case "<=":
+			ok = order <= 0
+		default:
+			invariant.Unreachable("Version constraint operators were validated during parsing")
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Compares dot separated release numbers numerically, treating missing components as 0. A pre-release suffix
+// (e.g. 1.0.0-rc.1) sorts before its release. Returns -1, 0, or 1 like cmp.Compare.
+func compare_versions(a, b string) int {
+	a_release, a_prerelease, _ := strings.Cut(a, "-")
+	b_release, b_prerelease, _ := strings.Cut(b, "-")
+	a_parts := strings.Split(a_release, ".")
+	b_parts := strings.Split(b_release, ".")
+	for i := range max(len(a_parts), len(b_parts)) {
+		a_part, b_part := "0", "0"
+		if i < len(a_parts) {
+			a_part = a_parts[i]
+		}
+		if i < len(b_parts) {
+			b_part = b_parts[i]
+		}
+		a_number, a_err := strconv.Atoi(a_part)
+		b_number, b_err := strconv.Atoi(b_part)
+		if a_err == nil && b_err == nil {
+			if order := cmp.Compare(a_number, b_number); order != 0 {
+				return order
+			}
+		} else if order := strings.Compare(a_part, b_part); order != 0 {
+			return order
+		}
+	}
+	switch {
+	case a_prerelease == b_prerelease:
+		return 0
+	case a_prerelease == "":
+		return 1
+	case b_prerelease == "":
+		return -1
+	default:
+		return strings.Compare(a_prerelease, b_prerelease)
+	}
+}
+
+const health_probe_workers = 8
+
+// A variable so tests can shorten it.
+var health_probe_timeout = 10 * time.Second
+
+// Health check results are cached for the rest of the run. An artifact must be forgotten before it is modified so that
+// the next probe reflects the change.
+type Health_Cache struct {
+	mutex   sync.Mutex
+	results map[string]error
+}
+
+func (cache *Health_Cache) get(name string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	reason, ok := cache.results[name]
+	invariant.Always(ok, "Artifact health is probed before it is read")
+	return reason
+}
+
+func (cache *Health_Cache) forget(name string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.results, name)
+}
+
+// Runs the health checks of all uncached artifacts concurrently with a bounded number of workers. Each check gets its own
+// timeout, after which it counts as failed.
+func (cache *Health_Cache) probe(artifacts map[string]Artifact, lgr *itlog.Logger) {
+	cache.mutex.Lock()
+	if cache.results == nil {
+		cache.results = make(map[string]error, len(artifacts))
+	}
+	var pending []Artifact
+	for name, artifact := range artifacts {
+		if _, ok := cache.results[name]; !ok {
+			pending = append(pending, artifact)
+		}
+	}
+	cache.mutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	lgr.Info().Begin("probing health")
+	defer tracer.span("probing health", "")()
+	queue := make(chan Artifact)
+	var wg sync.WaitGroup
+	for range min(health_probe_workers, len(pending)) {
+		wg.Go(func() {
+			for artifact := range queue {
+				invariant.Always(artifact.Checkhealth != nil, "All artifacts had their Checkhealth function set")
+				ctx, cancel := context.WithTimeout(context.Background(), health_probe_timeout)
+				end := tracer.span("health check", artifact.Name)
+				reason := artifact.Checkhealth(ctx)
+				end()
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					reason = fmt.Errorf("%s health check timed out after %s", artifact.Name, health_probe_timeout)
+				}
+				cancel()
+				cache.mutex.Lock()
+				cache.results[artifact.Name] = reason
+				cache.mutex.Unlock()
+			}
+		})
+	}
+	for _, artifact := range pending {
+		queue <- artifact
+	}
+	close(queue)
+	wg.Wait()
+	lgr.Info().Done("probing health")
+}
+
+type Git_Build struct {
+	Repository string
+	Tag        string
+	// The full commit hash that Tag must resolve to. Tags can be moved, commits can't. If unset, the build fails after
+	// cloning and logs what the tag resolved to, so it can be checked against upstream and copied into the source code.
+	Commit string
+	// Optional. Runs inside the clone before Build, e.g. `cargo vendor`.
+	Vendor []string
+	// Runs inside the clone. The first element is the executable.
+	Build []string
+	// Extra environment variables for Vendor and Build in the form KEY=VALUE.
+	Environment []string
+	// Paths relative to the clone root that Build produces. Each one is moved into BIG_BANG_BIN under its base name.
+	Binaries []string
+}
+
+type Go_Install struct {
+	// The package path passed to `go install`. It must build an executable named Artifact.Name.
+	Package string
+	// The module that provides Package. Defaults to Package.
+	Module  string
+	Version string
+}
+
+func (recipe *Go_Install) module() string {
+	if recipe.Module == "" {
+		return recipe.Package
+	}
+	return recipe.Module
+}
+
+// Compares the build info embedded in the binary at path against the recipe.
+func (recipe *Go_Install) matches_build_info(ctx context.Context, path string) error {
+	info, err := go_build_info(ctx, path)
+	if err != nil {
+		return err
+	}
+	if info.Path != recipe.Package {
+		return fmt.Errorf("%s was built from package %q, expected %q", filepath.Base(path), info.Path, recipe.Package)
+	}
+	if info.Module != recipe.module() {
+		return fmt.Errorf("%s was built from module %q, expected %q", filepath.Base(path), info.Module, recipe.module())
+	}
+	if info.Version != recipe.Version {
+		return fmt.Errorf("%s is wrong version. expected %q. got %q", filepath.Base(path), recipe.Version, info.Version)
+	}
+	return nil
+}
+
+type Cargo_Install struct {
+	Crate string
+	// Exact crate version without the leading "v".
+	Version  string
+	Locked   bool
+	Features []string
+	// Optional rustup toolchain, e.g. "1.86.0". Installed with the minimal profile if missing. Defaults to the stable
+	// toolchain set up by the cargo artifact.
+	Toolchain string
+	// Executables installed by the crate. Defaults to Artifact.Name.
+	Binaries []string
+}
+
+func (recipe *Cargo_Install) binaries(artifact_name string) []string {
+	if len(recipe.Binaries) == 0 {
+		return []string{artifact_name}
+	}
+	return recipe.Binaries
+}
+
+func (recipe *Cargo_Install) matches_install_list(ctx context.Context, root string) error {
+	invariant.Always(filepath.IsAbs(root), "")
+	if which("cargo") == "" {
+		return fmt.Errorf("cargo is not installed")
+	}
+	output, err := pipe_strict(ctx, "cargo", "install", "--list", "--root", root)
+	if err != nil {
+		return fmt.Errorf("listing installed crates: %w", err)
+	}
+	return recipe.check_install_list(output, root)
+}
+
+// Parses the output of `cargo install --list` which looks like:
+//
+//	stylua v2.1.0:
+//	    stylua
+func (recipe *Cargo_Install) check_install_list(output, root string) error {
+	var installed_version string
+	var installed_binaries []string
+	current_crate := ""
+	for line := range strings.Lines(output) {
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			fields := strings.Fields(strings.TrimSuffix(line, ":"))
+			current_crate = ""
+			if len(fields) >= 2 && fields[0] == recipe.Crate {
+				current_crate = fields[0]
+				installed_version = strings.TrimPrefix(fields[1], "v")
+			}
+			continue
+		}
+		if current_crate != "" {
+			installed_binaries = append(installed_binaries, strings.TrimSpace(line))
+		}
+	}
+	if installed_version == "" {
+		return fmt.Errorf("crate %s is not installed in %s", recipe.Crate, root)
+	}
+	if installed_version != recipe.Version {
+		return fmt.Errorf("crate %s is wrong version. expected %q. got %q", recipe.Crate, recipe.Version, installed_version)
+	}
+	for _, binary := range recipe.Binaries {
+		if !slices.Contains(installed_binaries, binary) {
+			return fmt.Errorf("crate %s does not provide binary %q", recipe.Crate, binary)
+		}
+	}
+	return nil
+}
+
+// Each crate gets its own install root so that cargo's metadata only describes that crate. They're kept apart from the
+// BIG_BANG_SHARE/<name> trees of other artifacts so an artifact can't share a directory with a crate of the same name.
+func cargo_install_root(artifact_name string) string {
+	invariant.Always(artifact_name != "", "")
+	return filepath.Join(cargo_installs_dir(), artifact_name)
+}
+
+func cargo_installs_dir() string {
+	return filepath.Join(BIG_BANG_SHARE, "cargo-installs")
+}
+
+type Go_Build_Info struct {
+	Path    string
+	Module  string
+	Version string
+}
+
+// Parses the output of `go version -m`:
+//
+//	/path/to/binary: go1.25.3
+//		path	golang.org/x/tools/gopls
+//		mod	golang.org/x/tools/gopls	v0.20.0	h1:...
+//		dep	...
+func go_build_info(ctx context.Context, binary_path string) (info Go_Build_Info, err error) {
+	invariant.Always(filepath.IsAbs(binary_path), "")
+	output, err := pipe_strict(ctx, "go", "version", "-m", binary_path)
+	if err != nil {
+		return info, fmt.Errorf("reading build info of %s: %w", binary_path, err)
+	}
+	for line := range strings.Lines(output) {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 2 && fields[0] == "path":
+			info.Path = fields[1]
+		case len(fields) >= 3 && fields[0] == "mod":
+			info.Module = fields[1]
+			info.Version = fields[2]
+		}
+	}
+	if info.Path == "" || info.Module == "" {
+		return info, fmt.Errorf("%s has no module build info", binary_path)
+	}
+	return info, nil
+}
+
+// Bump this whenever the shape of State changes and teach load_state how to migrate from the previous version.
+const state_schema_version = 1
+
+// State is what big_bang remembers about the machine between runs. It lives in BIG_BANG_DATA_DIR/state.json.
+type State struct {
+	Schema_Version int `json:"schema_version"`
+	// Keyed by artifact name.
+	Artifacts map[string]Artifact_Record `json:"artifacts"`
+	// Keyed by the absolute destination path in HOME.
+	Dotfiles map[string]Dotfile_Record `json:"dotfiles"`
+
+	mutex sync.Mutex
+}
+
+type Artifact_Record struct {
+	Version    string `json:"version"`
+	Source_URL string `json:"source_url"`
+	// Only set for direct binary downloads.
+	Archive_Sha256 string           `json:"archive_sha256,omitempty"`
+	Files          []Installed_File `json:"files"`
+	Installed_At   time.Time        `json:"installed_at"`
+}
+
+type Installed_File struct {
+	Path string `json:"path"`
+	// Empty for symlinks.
+	Sha256 string `json:"sha256,omitempty"`
+	// The link target if the file is a symlink.
+	Symlink string `json:"symlink,omitempty"`
+}
+
+type Dotfile_Record struct {
+	// The repo file that was written.
+	Source string `json:"source"`
+	// Empty for symlinks. For encrypted sources it's the hash of the encrypted repo file, see dotfile_record_sha.
+	Sha256 string `json:"sha256"`
+	// The link target if the dotfile was synced with strategy_symlink.
+	Symlink    string    `json:"symlink,omitempty"`
+	Written_At time.Time `json:"written_at"`
+}
+
+func state_file_path() string {
+	return filepath.Join(BIG_BANG_DATA_DIR, "state.json")
+}
+
+// A missing state file is an empty state. A state file written by a newer big_bang is an error rather than something to
+// silently downgrade.
+func load_state() (*State, error) {
+	state := &State{
+		Schema_Version: state_schema_version,
+		Artifacts:      make(map[string]Artifact_Record),
+		Dotfiles:       make(map[string]Dotfile_Record),
+	}
+	contents, err := os.ReadFile(state_file_path())
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, state); err != nil {
+		return nil, fmt.Errorf("parsing state file: %w", err)
+	}
+	switch {
+	case state.Schema_Version > state_schema_version:
+		return nil, fmt.Errorf("state file has schema version %d but this big_bang only knows up to %d", state.Schema_Version, state_schema_version)
+	case state.Schema_Version < 1:
+		return nil, fmt.Errorf("state file has invalid schema version %d", state.Schema_Version)
+	}
+	if state.Artifacts == nil {
+		state.Artifacts = make(map[string]Artifact_Record)
+	}
+	if state.Dotfiles == nil {
+		state.Dotfiles = make(map[string]Dotfile_Record)
+	}
+	return state, nil
+}
+
+// Writes to a temporary file in the same directory then renames it over the state file so that a crash never leaves a
+// half written state behind.
+func (state *State) save() error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.Schema_Version = state_schema_version
+	contents, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	handle, err := os.CreateTemp(filepath.Dir(state_file_path()), ".state.json.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(handle.Name())
+	if _, err := handle.Write(append(contents, '\n')); err != nil {
+		handle.Close()
+		return err
+	}
+	if err := handle.Sync(); err != nil {
+		handle.Close()
+		return err
+	}
+	if err := handle.Close(); err != nil {
+		return err
+	}
+	return os.Rename(handle.Name(), state_file_path())
+}
+
+// Hashes every installed file. Directories are walked so that retained installation trees are recorded file by file.
+func (state *State) record_artifact(artifact Artifact, installed []string) error {
+	record := Artifact_Record{
+		Version:      artifact.Version,
+		Installed_At: time.Now().UTC(),
+	}
+	switch {
+	case artifact.Git_Build != nil:
+		record.Source_URL = "git+" + artifact.Git_Build.Repository + "@" + artifact.Git_Build.Commit
+	case artifact.Go_Install != nil:
+		record.Version = artifact.Go_Install.Version
+		record.Source_URL = "https://pkg.go.dev/" + artifact.Go_Install.Package + "@" + artifact.Go_Install.Version
+	case artifact.Cargo_Install != nil:
+		record.Version = artifact.Cargo_Install.Version
+		record.Source_URL = "https://crates.io/crates/" + artifact.Cargo_Install.Crate + "/" + artifact.Cargo_Install.Version
+	default:
+		record.Source_URL = artifact.Download_Link
+		record.Archive_Sha256 = artifact.Checksum
+	}
+	for _, path := range installed {
+		invariant.Always(filepath.IsAbs(path), "Installed paths are absolute")
+		if err := filepath.WalkDir(path, func(file_path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			file, err := hash_installed_file(file_path)
+			if err != nil {
+				return err
+			}
+			record.Files = append(record.Files, file)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.Artifacts[artifact.Name] = record
+	return nil
+}
+
+// The written contents are kept as the base of later three-way merges. See merge_dotfile.
+func (state *State) record_dotfile(source, destination string, contents []byte) error {
+	invariant.Always(filepath.IsAbs(source), "")
+	invariant.Always(filepath.IsAbs(destination), "")
+	sha, err := dotfile_record_sha(source, contents)
+	if err != nil {
+		return err
+	}
+	// Secrets aren't kept in plaintext outside of HOME so they can't be merged.
+	if base := dotfile_base_path(sha); !strings.HasSuffix(source, encrypted_suffix) && !file_exists(base) {
+		if err := os.MkdirAll(filepath.Dir(base), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(base, contents, 0o600); err != nil {
+			return err
+		}
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.Dotfiles[destination] = Dotfile_Record{
+		Source:     source,
+		Sha256:     sha,
+		Written_At: time.Now().UTC(),
+	}
+	return nil
+}
+
+// Records a dotfile that already matches the repo. The record is left alone if it's up to date so Written_At keeps
+// saying when big_bang last wrote the file.
+func (state *State) track_dotfile(source, destination string) error {
+	contents, err := os.ReadFile(destination)
+	if err != nil {
+		return err
+	}
+	sha, err := dotfile_record_sha(source, contents)
+	if err != nil {
+		return err
+	}
+	state.mutex.Lock()
+	record, ok := state.Dotfiles[destination]
+	state.mutex.Unlock()
+	// Encrypted sources never get a base, see record_dotfile.
+	has_base := strings.HasSuffix(source, encrypted_suffix) || file_exists(dotfile_base_path(sha))
+	if ok && record.Source == source && record.Sha256 == sha && has_base {
+		return nil
+	}
+	return state.record_dotfile(source, destination, contents)
+}
+
+// The hash a record keeps of what was written. Encrypted sources are hashed as they are in the repo since even the hash
+// of a short secret can give it away.
+func dotfile_record_sha(source string, contents []byte) (sha string, err error) {
+	if strings.HasSuffix(source, encrypted_suffix) {
+		if contents, err = os.ReadFile(source); err != nil {
+			return "", err
+		}
+	}
+	checksum := sha256.Sum256(contents)
+	return hex.EncodeToString(checksum[:]), nil
+}
+
+func (state *State) record_dotfile_symlink(source, destination string) {
+	invariant.Always(filepath.IsAbs(source), "")
+	invariant.Always(filepath.IsAbs(destination), "")
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if record, ok := state.Dotfiles[destination]; ok && record.Symlink == source {
+		return
+	}
+	state.Dotfiles[destination] = Dotfile_Record{Source: source, Symlink: source, Written_At: time.Now().UTC()}
+}
+
+func (state *State) forget_dotfile(destination string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	delete(state.Dotfiles, destination)
+}
+
+func hash_installed_file(path string) (Installed_File, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return Installed_File{}, err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return Installed_File{}, err
+		}
+		return Installed_File{Path: path, Symlink: target}, nil
+	}
+	handle, err := os.Open(path)
+	if err != nil {
+		return Installed_File{}, err
+	}
+	defer handle.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, handle); err != nil {
+		return Installed_File{}, err
+	}
+	return Installed_File{Path: path, Sha256: hex.EncodeToString(hasher.Sum(nil))}, nil
+}
+
 /* https://patorjk.com/software/taag/#p=display&v=0&f=ANSI%20Shadow&t=coreutils
 
 
@@ -966,7 +6137,36 @@ func pipe_with_error(cmd string, args ...string) (string, error) {
 	return output, errors.New(err)
 }
 
-func spawn(working_directory string, environment []string, binary string, arguments ...string) error {
+// Like pipe but the command is killed once ctx is done. Stdin is /dev/null so that a program waiting on input can't hang.
+func pipe_context(ctx context.Context, cmd string, args ...string) string {
+	c := exec.CommandContext(ctx, cmd, args...)
+	// Children that inherited stdout would otherwise keep Wait blocked after the kill.
+	c.WaitDelay = time.Second
+	var buf bytes.Buffer
+	c.Stdout = &buf
+	c.Run()
+	output, _ := strings.CutSuffix(buf.String(), "\n")
+	return output
+}
+
+// Like pipe_with_error but the error is only non-nil when the command fails.
+func pipe_strict(ctx context.Context, cmd string, args ...string) (string, error) {
+	c := exec.CommandContext(ctx, cmd, args...)
+	c.WaitDelay = time.Second
+	var bufout bytes.Buffer
+	var buferr bytes.Buffer
+	c.Stdout = &bufout
+	c.Stderr = &buferr
+	if err := c.Run(); err != nil {
+		stderr, _ := strings.CutSuffix(buferr.String(), "\n")
+		return "", fmt.Errorf("%w: %s", err, stderr)
+	}
+	output, _ := strings.CutSuffix(bufout.String(), "\n")
+	return output, nil
+}
+
+// A nil output streams the child's stdout and stderr to the terminal, see child_terminal.
+func spawn(output io.Writer, working_directory string, environment []string, binary string, arguments ...string) error {
 	cmd := exec.Command(binary, arguments...)
 	if len(environment) > 0 {
 		cmd.Env = os.Environ()
@@ -978,11 +6178,16 @@ func spawn(working_directory string, environment []string, binary string, argume
 		cmd.Dir = working_directory
 	}
 	buf := &bytes.Buffer{}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = io.MultiWriter(os.Stderr, buf)
+	if output == nil {
+		cmd.Stdout = child_terminal()
+		cmd.Stderr = io.MultiWriter(os.Stderr, buf)
+	} else {
+		cmd.Stdout = output
+		cmd.Stderr = io.MultiWriter(output, buf)
+	}
 	cmd.Stdin = os.Stdin
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf(buf.String())
+		return errors.New(buf.String())
 	}
 	return nil
 }
@@ -0,0 +1,1570 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/james-orcales/golang_snacks/itlog"
+)
+
+// Points a package-level variable somewhere else for the duration of a test.
+func set_global[T any](t *testing.T, global *T, value T) {
+	t.Helper()
+	previous := *global
+	*global = value
+	t.Cleanup(func() { *global = previous })
+}
+
+func quiet_logger() *itlog.Logger {
+	return itlog.New(io.Discard, itlog.LevelError)
+}
+
+func run_git(t *testing.T, dir string, arguments ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-C", dir}, arguments...)...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(arguments, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// A bare repo with a tagged build script that produces out/hello.
+func bare_repo_with_build_script(t *testing.T) (repository, commit string) {
+	t.Helper()
+	if which("git") == "" {
+		t.Skip("git is not installed")
+	}
+	work := t.TempDir()
+	run_git(t, work, "init", "--quiet")
+	script := "#!/bin/sh\nmkdir -p out\nprintf '#!/bin/sh\\necho hello\\n' > out/hello\n"
+	if err := os.WriteFile(filepath.Join(work, "build.sh"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	run_git(t, work, "add", "build.sh")
+	run_git(t, work, "commit", "--quiet", "--message=build script")
+	run_git(t, work, "tag", "v1")
+	commit = run_git(t, work, "rev-parse", "HEAD")
+	bare := filepath.Join(t.TempDir(), "hello.git")
+	run_git(t, work, "clone", "--quiet", "--bare", work, bare)
+	return "file://" + bare, commit
+}
+
+func Test_Install_Git_Build(t *testing.T) {
+	repository, commit := bare_repo_with_build_script(t)
+	for _, test := range []struct {
+		name   string
+		commit string
+		ok     bool
+	}{
+		{"pinned", commit, true},
+		{"unpinned", "", false},
+		{"moved tag", strings.Repeat("0", len(commit)), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			set_global(t, &BIG_BANG_TMP, t.TempDir())
+			set_global(t, &BIG_BANG_BIN, t.TempDir())
+			artifact := Artifact{
+				Name: "hello",
+				Git_Build: &Git_Build{
+					Repository: repository,
+					Tag:        "v1",
+					Commit:     test.commit,
+					Build:      []string{"sh", "build.sh"},
+					Binaries:   []string{"out/hello"},
+				},
+			}
+			installed, ok := install_git_build(artifact, quiet_logger())
+			if ok != test.ok {
+				t.Fatalf("ok = %v, want %v", ok, test.ok)
+			}
+			binary := filepath.Join(BIG_BANG_BIN, "hello")
+			if !test.ok {
+				if file_exists(binary) {
+					t.Error("a failed build touched BIG_BANG_BIN")
+				}
+				return
+			}
+			if !slices.Equal(installed, []string{binary}) {
+				t.Errorf("installed = %v, want %v", installed, []string{binary})
+			}
+			output, err := exec.Command(binary).Output()
+			if err != nil || string(output) != "hello\n" {
+				t.Errorf("running the built binary: %q, %v", output, err)
+			}
+			entries, _ := os.ReadDir(BIG_BANG_TMP)
+			if len(entries) != 0 {
+				t.Errorf("the build directory was left behind: %v", entries)
+			}
+		})
+	}
+}
+
+func Test_Install_Order(t *testing.T) {
+	artifacts := map[string]Artifact{
+		"stylua": {Name: "stylua", Depends_On: []string{"cargo"}},
+		"fish":   {Name: "fish", Depends_On: []string{"cargo"}},
+		"cargo":  {Name: "cargo"},
+		"fzf":    {Name: "fzf"},
+		// Its dependency is healthy so it isn't in the map.
+		"lazygit": {Name: "lazygit", Depends_On: []string{"go"}},
+	}
+	var names []string
+	for _, artifact := range install_order(artifacts) {
+		names = append(names, artifact.Name)
+	}
+	if want := []string{"cargo", "fish", "fzf", "lazygit", "stylua"}; !slices.Equal(names, want) {
+		t.Errorf("install_order = %v, want %v", names, want)
+	}
+
+	cycle := map[string]Artifact{
+		"a": {Name: "a", Depends_On: []string{"b"}},
+		"b": {Name: "b", Depends_On: []string{"a"}},
+	}
+	if ordered := install_order(cycle); len(ordered) == len(cycle) {
+		t.Error("a dependency cycle was ordered")
+	}
+}
+
+func Test_Parse_Version_Constraint(t *testing.T) {
+	for _, test := range []struct {
+		raw  string
+		want Version_Constraint
+	}{
+		{"1.2.3", Version_Constraint{{"=", "1.2.3"}}},
+		{"v1.2", Version_Constraint{{"=", "1.2"}}},
+		{"== 1.2.3-rc.1", Version_Constraint{{"=", "1.2.3-rc.1"}}},
+		{">=0.11, <0.12", Version_Constraint{{">=", "0.11"}, {"<", "0.12"}}},
+		{"!=2.0.0,<=3.0", Version_Constraint{{"!=", "2.0.0"}, {"<=", "3.0"}}},
+	} {
+		got, err := parse_version_constraint(test.raw)
+		if err != nil || !slices.Equal(got, test.want) {
+			t.Errorf("parse_version_constraint(%q) = %v, %v, want %v", test.raw, got, err, test.want)
+		}
+	}
+	for _, raw := range []string{"", ">=", "foo1.2.3bar", "1.2.3 beta", ">=0.11,", "~1.2", "1"} {
+		if got, err := parse_version_constraint(raw); err == nil {
+			t.Errorf("parse_version_constraint(%q) = %v, want an error", raw, got)
+		}
+	}
+}
+
+func Test_Version_Constraint_Allows(t *testing.T) {
+	for _, test := range []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{">=0.11, <0.12", "0.11.3", true},
+		{">=0.11, <0.12", "0.12.0", false},
+		{">=0.11, <0.12", "v0.11", true},
+		{"=1.2", "1.2.0", true},
+		{"!=1.2.0", "1.2", false},
+		{">1.0.0-rc.1", "1.0.0", true},
+		{"<1.0.0", "1.0.0-rc.1", true},
+		{">1.9", "1.10", true},
+	} {
+		constraint, err := parse_version_constraint(test.constraint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := constraint.allows(test.version); got != test.want {
+			t.Errorf("%q allows %q = %v, want %v", test.constraint, test.version, got, test.want)
+		}
+	}
+}
+
+func Test_Detect_Drift(t *testing.T) {
+	set_global(t, &BIG_BANG_BIN, t.TempDir())
+	set_global(t, &BIG_BANG_SHARE, t.TempDir())
+	write := func(name, contents string) string {
+		path := filepath.Join(BIG_BANG_BIN, name)
+		if err := os.WriteFile(path, []byte(contents), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	recorded := write("fzf", "fzf")
+	file, err := hash_installed_file(recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &State{Artifacts: map[string]Artifact_Record{"fzf": {Files: []Installed_File{file}}}}
+	write("fzf", "tampered")
+	// Installed before the state file existed.
+	write("rg", "rg")
+	stray := write("stray", "stray")
+	artifacts := map[string]Artifact{"fzf": {Name: "fzf"}, "rg": {Name: "rg"}}
+
+	drifts, err := detect_drift(state, artifacts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Drift{{Kind: "modified", Artifact: "fzf", Path: recorded}, {Kind: "added", Path: stray}}
+	if !slices.Equal(drifts, want) {
+		t.Errorf("detect_drift = %v, want %v", drifts, want)
+	}
+}
+
+func Test_Prune_Download_Cache(t *testing.T) {
+	set_global(t, &BIG_BANG_DATA_DIR, t.TempDir())
+	artifact := Artifact{Name: "fzf", Checksum: "new"}
+	for _, sha := range []string{"old", "older", "new"} {
+		dir := filepath.Join(download_cache_dir(artifact.Name), sha)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "fzf.tar.gz"), []byte(sha), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := prune_download_cache(artifact); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(download_cache_dir(artifact.Name))
+	if err != nil || len(entries) != 1 || entries[0].Name() != "new" {
+		t.Errorf("cache after pruning = %v, %v, want only new", entries, err)
+	}
+	if err := prune_download_cache(Artifact{Name: "uncached", Checksum: "sha"}); err != nil {
+		t.Errorf("pruning a missing cache: %v", err)
+	}
+}
+
+func Test_Find_Orphans(t *testing.T) {
+	set_global(t, &BIG_BANG_BIN, t.TempDir())
+	set_global(t, &BIG_BANG_SHARE, t.TempDir())
+	set_global(t, &BIG_BANG_MAN, t.TempDir())
+	for _, path := range []string{
+		filepath.Join(BIG_BANG_BIN, "fzf"),
+		filepath.Join(BIG_BANG_BIN, "stray"),
+		filepath.Join(BIG_BANG_SHARE, "nvim", "bin", "nvim"),
+		filepath.Join(BIG_BANG_MAN, "man1", "fzf.1"),
+		filepath.Join(BIG_BANG_MAN, "man1", "nvim.1"),
+		filepath.Join(BIG_BANG_MAN, "man5", "stray.5"),
+		filepath.Join(BIG_BANG_SHARE, "cargo-installs", "stylua", ".crates.toml"),
+		filepath.Join(BIG_BANG_SHARE, "cargo-installs", "removed", ".crates.toml"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := &State{Artifacts: map[string]Artifact_Record{
+		"nvim": {Files: []Installed_File{{Path: filepath.Join(BIG_BANG_MAN, "man1", "nvim.1")}}},
+	}}
+	orphans, err := find_orphans(state, map[string]Artifact{
+		"fzf":    {Name: "fzf", Man_Pages: []string{"fzf.1"}},
+		"nvim":   {Name: "nvim"},
+		"stylua": {Name: "stylua", Cargo_Install: &Cargo_Install{Crate: "stylua", Version: "2.1.0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, orphan := range orphans {
+		paths = append(paths, orphan.Path)
+	}
+	want := []string{
+		filepath.Join(BIG_BANG_BIN, "stray"),
+		filepath.Join(BIG_BANG_SHARE, "cargo-installs", "removed"),
+		filepath.Join(BIG_BANG_MAN, "man5", "stray.5"),
+	}
+	slices.Sort(want)
+	if !slices.Equal(paths, want) {
+		t.Errorf("find_orphans = %v, want %v", paths, want)
+	}
+}
+
+func Test_Install_Artifact_Man_Pages(t *testing.T) {
+	for _, retain := range []bool{false, true} {
+		t.Run("retain="+strconv.FormatBool(retain), func(t *testing.T) {
+			set_global(t, &BIG_BANG_BIN, t.TempDir())
+			set_global(t, &BIG_BANG_SHARE, t.TempDir())
+			set_global(t, &BIG_BANG_MAN, t.TempDir())
+			set_global(t, &BIG_BANG_TMP, t.TempDir())
+			unpacked := filepath.Join(BIG_BANG_TMP, "tool")
+			write_file(t, filepath.Join(unpacked, "src", "tool-1.0", "tool"), "#!/bin/sh\n", 0o755)
+			write_file(t, filepath.Join(unpacked, "src", "tool-1.0", "doc", "tool.1"), ".TH TOOL 1\n", 0o644)
+			archive := filepath.Join(unpacked, "tool.tar.gz")
+			if output, err := exec.Command("tar", "--create", "--gzip", "--file", archive, "--directory", filepath.Join(unpacked, "src"), "tool-1.0").CombinedOutput(); err != nil {
+				t.Fatalf("tar: %v\n%s", err, output)
+			}
+			if err := os.RemoveAll(filepath.Join(unpacked, "src")); err != nil {
+				t.Fatal(err)
+			}
+			set_global(t, &PATH, []string{filepath.Join(BIG_BANG_SHARE, "tool", "tool-1.0")})
+
+			artifact := Artifact{Name: "tool", Man_Pages: []string{"tool.1"}, Retain_Installation_Dir: retain}
+			installed, ok := install_artifact(artifact, archive, quiet_logger())
+			if !ok {
+				t.Fatal("install failed")
+			}
+			page := filepath.Join(BIG_BANG_MAN, "man1", "tool.1")
+			if !slices.Contains(installed, page) {
+				t.Errorf("installed = %v, want it to include %s", installed, page)
+			}
+			if contents, err := os.ReadFile(page); err != nil || string(contents) != ".TH TOOL 1\n" {
+				t.Errorf("reading the installed man page: %q, %v", contents, err)
+			}
+			info, err := os.Lstat(page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if is_symlink := info.Mode()&fs.ModeSymlink != 0; is_symlink != retain {
+				t.Errorf("man page is a symlink: %v, want %v", is_symlink, retain)
+			}
+
+			state := &State{Artifacts: map[string]Artifact_Record{}}
+			if err := state.record_artifact(artifact, installed); err != nil {
+				t.Fatal(err)
+			}
+			orphans, err := find_orphans(state, map[string]Artifact{"tool": artifact})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(orphans) != 0 {
+				t.Errorf("find_orphans = %v, want none", orphans)
+			}
+		})
+	}
+}
+
+func Test_Environment_Problems(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "james-orcales", "code", "big_bang")
+	for name, global := range map[string]*string{
+		"data":  &BIG_BANG_DATA_DIR,
+		"share": &BIG_BANG_SHARE,
+		"man":   &BIG_BANG_MAN,
+		"bin":   &BIG_BANG_BIN,
+	} {
+		dir := filepath.Join(root, name)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		set_global(t, global, dir)
+	}
+	set_global(t, &BIG_BANG_GIT_DIR, root)
+	set_global(t, &PATH, []string{"/usr/bin", "/bin"})
+	if problems := environment_problems(); len(problems) != 0 {
+		t.Fatalf("environment_problems = %v, want none", problems)
+	}
+
+	set_global(t, &PATH, []string{"/usr/bin", "."})
+	set_global(t, &BIG_BANG_MAN, filepath.Join(root, "missing"))
+	set_global(t, &BIG_BANG_BIN, ".")
+	want := []string{
+		`PATH entry "." is not an absolute path`,
+		"BIG_BANG_MAN=" + filepath.Join(root, "missing") + " does not exist",
+		"BIG_BANG_BIN is not set to an absolute path",
+	}
+	if problems := environment_problems(); !slices.Equal(problems, want) {
+		t.Errorf("environment_problems = %v, want %v", problems, want)
+	}
+}
+
+// With --output=json stdout carries nothing but events, one JSON document per line.
+func Test_Json_Output_Keeps_Child_Output_Off_Stdout(t *testing.T) {
+	set_global(t, &BIG_BANG_DATA_DIR, t.TempDir())
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	stderr, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	set_global(t, &os.Stdout, stdout)
+	set_global(t, &os.Stderr, stderr)
+	set_global(t, &events, &Event_Stream{writer: stdout})
+	log, err := open_run_log("install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set_global(t, &run_log, log)
+
+	events.emit(Event{Type: "phase_begin", Phase: "install"})
+	if err := spawn(log.child_output("fzf"), "", nil, "echo", "artifact output"); err != nil {
+		t.Fatal(err)
+	}
+	if err := spawn(nil, "", nil, "echo", "system preferences output"); err != nil {
+		t.Fatal(err)
+	}
+	events.emit(Event{Type: "phase_done", Phase: "install"})
+	log.finish(&Run_Report{}, exit_ok)
+
+	contents, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("stdout has %d lines, want 2 events:\n%s", len(lines), contents)
+	}
+	for _, line := range lines {
+		var event Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil || event.Type == "" {
+			t.Errorf("stdout line %q is not an event: %v", line, err)
+		}
+	}
+	contents, _ = os.ReadFile(stderr.Name())
+	for _, output := range []string{"artifact output", "system preferences output"} {
+		if !strings.Contains(string(contents), output) {
+			t.Errorf("stderr is missing %q:\n%s", output, contents)
+		}
+	}
+}
+
+func Test_Level_Writer(t *testing.T) {
+	var forwarded bytes.Buffer
+	lgr := itlog.New(Level_Writer{&forwarded, itlog.LevelWarn}, itlog.LevelDebug)
+	lgr.Debug().Msg("debug")
+	lgr.Info().Str("level", "WRN").Msg("info")
+	lgr.Warn().Msg("warn")
+	lgr.Error(nil).Msg("error")
+	var messages []string
+	for line := range strings.Lines(forwarded.String()) {
+		messages = append(messages, log_message(line))
+	}
+	if want := []string{"warn", "error"}; !slices.Equal(messages, want) {
+		t.Errorf("forwarded %v, want %v", messages, want)
+	}
+}
+
+func Test_Run_History(t *testing.T) {
+	set_global(t, &BIG_BANG_DATA_DIR, t.TempDir())
+	// Runs started within the same second used to collide.
+	first, err := open_run_log("install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := open_run_log("sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &Run_Report{}
+	report.add(Report_Entry{Kind: "artifact", Name: "fzf", Outcome: outcome_installed})
+	first.finish(report, exit_ok)
+	if err := os.WriteFile(filepath.Join(run_log_dir(), "2025-06-10T12-00-00Z.log"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := list_run_logs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 3 || runs[2].Id != "2025-06-10T12-00-00Z" {
+		t.Fatalf("list_run_logs = %v, want both runs and the old one last", runs)
+	}
+	for _, run := range runs {
+		if err := run.read(); err != nil {
+			t.Fatal(err)
+		}
+		switch run.Id {
+		case first.id:
+			if run.Command != "install" || !run.Finished || run.Changed != 1 {
+				t.Errorf("first run = %+v, want a finished install that changed 1", run)
+			}
+		case second.id:
+			if run.Command != "sync" || run.Finished {
+				t.Errorf("second run = %+v, want an unfinished sync", run)
+			}
+		}
+	}
+}
+
+func Test_Run_Log_Pruning(t *testing.T) {
+	set_global(t, &BIG_BANG_DATA_DIR, t.TempDir())
+	set_global(t, &run_log_keep_count, 3)
+	set_global(t, &run_log_max_age, 24*time.Hour)
+	now := time.Now().UTC()
+	var ids []string
+	for _, age := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 48 * time.Hour} {
+		id := now.Add(-age).Format(run_log_time_format)
+		ids = append(ids, id)
+		write_file(t, filepath.Join(run_log_dir(), id+".log"), "", 0o644)
+	}
+	current, err := open_run_log("sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs, err := list_run_logs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, run := range runs {
+		kept = append(kept, run.Id)
+	}
+	if want := []string{current.id, ids[0], ids[1]}; !slices.Equal(kept, want) {
+		t.Errorf("kept runs %v, want %v", kept, want)
+	}
+
+	set_global(t, &run_log_keep_count, 100)
+	write_file(t, filepath.Join(run_log_dir(), ids[3]+".log"), "", 0o644)
+	if _, err := open_run_log("sync"); err != nil {
+		t.Fatal(err)
+	}
+	if file_exists(filepath.Join(run_log_dir(), ids[3]+".log")) {
+		t.Errorf("a run older than run_log_max_age was kept")
+	}
+}
+
+func Test_Parse_Positive_Int(t *testing.T) {
+	for _, test := range []struct {
+		raw  string
+		want int
+		ok   bool
+	}{
+		{"", 7, true},
+		{"1", 1, true},
+		{"30", 30, true},
+		{"0", 0, false},
+		{"-5", 0, false},
+		{"ten", 0, false},
+		{"1.5", 0, false},
+	} {
+		got, err := parse_positive_int(test.raw, 7)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parse_positive_int(%q) = %d, %v", test.raw, got, err)
+		}
+	}
+}
+
+// Points HOME and the dotfiles repo at empty directories and forgets the rules and template vars of other tests.
+func dotfiles_sandbox(t *testing.T) {
+	t.Helper()
+	set_global(t, &HOME, t.TempDir())
+	set_global(t, &BIG_BANG_GIT_DIR, t.TempDir())
+	set_global(t, &BIG_BANG_DATA_DIR, t.TempDir())
+	set_global(t, &big_bang_dotfiles_root, filepath.Join(BIG_BANG_GIT_DIR, "dotfiles"))
+	forget := func() {
+		dotfile_rules.loaded = false
+		template_vars.loaded = false
+	}
+	forget()
+	t.Cleanup(forget)
+}
+
+func write_file(t *testing.T, path, contents string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Diff_Lines(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want string
+	}{
+		{"", "", ""},
+		{"a\nb\n", "a\nb\n", " a\n b\n"},
+		{"", "a\n", "+a\n"},
+		{"a\n", "", "-a\n"},
+		{"a\nb\nc\n", "a\nc\n", " a\n-b\n c\n"},
+		{"a\nc\n", "a\nb\nc\n", " a\n+b\n c\n"},
+		{"a\nb\n", "a\nB\n", " a\n-b\n+B\n"},
+		{"a\nb\nc\nd\n", "b\nc\nd\ne\n", "-a\n b\n c\n d\n+e\n"},
+	} {
+		var got strings.Builder
+		for _, op := range diff_lines(split_lines([]byte(test.a)), split_lines([]byte(test.b))) {
+			got.WriteByte(op.Kind)
+			got.WriteString(op.Line)
+		}
+		if got.String() != test.want {
+			t.Errorf("diff_lines(%q, %q) =\n%s\nwant\n%s", test.a, test.b, got.String(), test.want)
+		}
+	}
+}
+
+func Test_Write_Dotfile_Diff(t *testing.T) {
+	dotfiles_sandbox(t)
+	var lines []string
+	for i := 1; i <= 12; i++ {
+		lines = append(lines, strconv.Itoa(i)+"\n")
+	}
+	actual := filepath.Join(HOME, ".config", "app.conf")
+	write_file(t, actual, strings.Join(lines, ""), 0o644)
+	lines[1] = "two\n"
+	lines[10] = "eleven\n"
+	expect := filepath.Join(big_bang_dotfiles_root, "common", ".config", "app.conf")
+	write_file(t, expect, strings.Join(lines, ""), 0o644)
+
+	var diff strings.Builder
+	added, removed, err := write_dotfile_diff(&diff, expect, actual, Diff_Colors{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `diff ~/.config/app.conf dotfiles/common/.config/app.conf
+--- ~/.config/app.conf
++++ dotfiles/common/.config/app.conf
+@@ -1,5 +1,5 @@
+ 1
+-2
++two
+ 3
+ 4
+ 5
+@@ -8,5 +8,5 @@
+ 8
+ 9
+ 10
+-11
++eleven
+ 12
+`
+	if diff.String() != want || added != 2 || removed != 2 {
+		t.Errorf("write_dotfile_diff = +%d -%d\n%s\nwant +2 -2\n%s", added, removed, diff.String(), want)
+	}
+
+	diff.Reset()
+	missing := filepath.Join(HOME, ".new")
+	write_file(t, filepath.Join(big_bang_dotfiles_root, "common", ".new"), "new\n", 0o755)
+	if _, _, err := write_dotfile_diff(&diff, filepath.Join(big_bang_dotfiles_root, "common", ".new"), missing, Diff_Colors{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff.String(), "new file mode 0755\n--- /dev/null\n") || !strings.HasSuffix(diff.String(), "@@ -0,0 +1,1 @@\n+new\n") {
+		t.Errorf("diff of a new file:\n%s", diff.String())
+	}
+}
+
+func Test_Merge_Lines(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+	for _, test := range []struct {
+		name         string
+		mine, theirs string
+		want         string
+		conflicts    int
+	}{
+		{"unchanged", base, base, base, 0},
+		{"only mine", "a\nB\nc\nd\ne\n", base, "a\nB\nc\nd\ne\n", 0},
+		{"only theirs", base, "a\nb\nc\nd\nE\n", "a\nb\nc\nd\nE\n", 0},
+		{"apart", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", 0},
+		{"same edit", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n", 0},
+		{"theirs appends", base, base + "f\n", base + "f\n", 0},
+		{
+			"same line", "a\nmine\nc\nd\ne\n", "a\ntheirs\nc\nd\ne\n",
+			"a\n<<<<<<< HOME\nmine\n||||||| last synced\nb\n=======\ntheirs\n>>>>>>> repo\nc\nd\ne\n", 1,
+		},
+		{
+			"adjacent", "a\nB\nc\nd\ne\n", "a\nb\nC\nd\ne\n",
+			"a\n<<<<<<< HOME\nB\nc\n||||||| last synced\nb\nc\n=======\nb\nC\n>>>>>>> repo\nd\ne\n", 1,
+		},
+		{
+			"no trailing newline", "a\nb\nc\nd\nmine", "a\nb\nc\nd\ntheirs",
+			"a\nb\nc\nd\n<<<<<<< HOME\nmine\n||||||| last synced\ne\n=======\ntheirs\n>>>>>>> repo\n", 1,
+		},
+	} {
+		merged, conflicts := merge_lines(
+			split_lines([]byte(base)), split_lines([]byte(test.mine)), split_lines([]byte(test.theirs)), "HOME", "repo",
+		)
+		if got := strings.Join(merged, ""); got != test.want || conflicts != test.conflicts {
+			t.Errorf("%s: merge_lines = %d conflicts\n%s\nwant %d\n%s", test.name, conflicts, got, test.conflicts, test.want)
+		}
+	}
+}
+
+func Test_Ask_Conflict_Resolution(t *testing.T) {
+	dotfiles_sandbox(t)
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	set_global(t, &os.Stdout, stdout)
+	actual := filepath.Join(HOME, ".profile")
+	expect := filepath.Join(big_bang_dotfiles_root, "common", ".profile")
+	write_file(t, actual, "mine\n", 0o644)
+	write_file(t, expect, "theirs\n", 0o644)
+	// Every answer arrives in one read, as it does when they're piped.
+	set_global(t, &stdin, bufio.NewReader(strings.NewReader("d\nm\nt\n")))
+	for _, want := range []string{conflict_merge, conflict_theirs, conflict_skip} {
+		if got := ask_conflict_resolution(expect, actual); got != want {
+			t.Errorf("ask_conflict_resolution = %q, want %q", got, want)
+		}
+	}
+}
+
+func Test_Parse_Profiles(t *testing.T) {
+	for _, test := range []struct {
+		raw  string
+		want []string
+	}{
+		{"", nil},
+		{"work", []string{"work"}},
+		{" work, ,gaming ", []string{"work", "gaming"}},
+		{"work.2025", []string{"work.2025"}},
+	} {
+		got, err := parse_profiles(test.raw)
+		if err != nil || !slices.Equal(got, test.want) {
+			t.Errorf("parse_profiles(%q) = %v, %v, want %v", test.raw, got, err, test.want)
+		}
+	}
+	for _, raw := range []string{"..", "work,..", "../../.ssh", "work/laptop", `work\laptop`, "."} {
+		if got, err := parse_profiles(raw); err == nil {
+			t.Errorf("parse_profiles(%q) = %v, want an error", raw, got)
+		}
+	}
+}
+
+func Test_Render_Dotfile_Template(t *testing.T) {
+	dotfiles_sandbox(t)
+	write_file(t, template_vars_path(), `{"email": "first@example.com"}`, 0o644)
+	rendered, err := render_dotfile_template("gitconfig.tmpl", []byte("{{.HOME}} {{.Local.email}}"))
+	if want := HOME + " first@example.com"; err != nil || string(rendered) != want {
+		t.Errorf("render_dotfile_template = %q, %v, want %q", rendered, err, want)
+	}
+	// The vars were loaded by the first template.
+	write_file(t, template_vars_path(), `{"email": "second@example.com"}`, 0o644)
+	rendered, err = render_dotfile_template("gitconfig.tmpl", []byte("{{.Local.email}}"))
+	if err != nil || string(rendered) != "first@example.com" {
+		t.Errorf("render_dotfile_template after editing vars.json = %q, %v", rendered, err)
+	}
+	if _, err := render_dotfile_template("gitconfig.tmpl", []byte("{{.Local.missing}}")); err == nil {
+		t.Error("a missing key rendered")
+	}
+}
+
+func Test_Encrypt_Dotfile(t *testing.T) {
+	plaintext := []byte("token = hunter2\n")
+	encrypted, err := encrypt_dotfile(plaintext, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(encrypted), encrypted_header) || bytes.Contains(encrypted, plaintext) {
+		t.Fatalf("encrypt_dotfile = %q", encrypted)
+	}
+	if decrypted, err := decrypt_dotfile(encrypted, "passphrase"); err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("decrypt_dotfile = %q, %v, want %q", decrypted, err, plaintext)
+	}
+	tampered := bytes.Replace(encrypted, []byte("v1"), []byte("v2"), 1)
+	truncated := []byte(encrypted_header + "AAAA\n")
+	for name, encrypted := range map[string][]byte{"wrong passphrase": encrypted, "tampered header": tampered, "truncated": truncated} {
+		passphrase := "passphrase"
+		if name == "wrong passphrase" {
+			passphrase = "guess"
+		}
+		if _, err := decrypt_dotfile(encrypted, passphrase); err == nil {
+			t.Errorf("%s: decrypt_dotfile succeeded", name)
+		}
+	}
+}
+
+func Test_Encrypted_Dotfile_Records(t *testing.T) {
+	dotfiles_sandbox(t)
+	set_global(t, &dotfile_secrets.passphrase, "passphrase")
+	set_global(t, &dotfile_secrets.decrypted, nil)
+	expect := filepath.Join(big_bang_dotfiles_root, "common", ".netrc.enc")
+	actual := filepath.Join(HOME, ".netrc")
+	encrypt := func(plaintext string) {
+		encrypted, err := encrypt_dotfile([]byte(plaintext), "passphrase")
+		if err != nil {
+			t.Fatal(err)
+		}
+		write_file(t, expect, string(encrypted), 0o644)
+	}
+	encrypt("password one\n")
+	write_file(t, actual, "password one\n", 0o644)
+	state := &State{Dotfiles: map[string]Dotfile_Record{}}
+	if err := state.track_dotfile(expect, actual); err != nil {
+		t.Fatal(err)
+	}
+	record := state.Dotfiles[actual]
+	if want, _ := dotfile_record_sha(expect, nil); record.Sha256 != want {
+		t.Errorf("recorded %s, want the hash of the encrypted repo file", record.Sha256)
+	}
+	if err := state.track_dotfile(expect, actual); err != nil || state.Dotfiles[actual] != record {
+		t.Errorf("tracking an unchanged encrypted dotfile re-recorded it: %v", err)
+	}
+
+	classify := func() string {
+		t.Helper()
+		class, err := classify_dotfile(state, expect, actual)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return class
+	}
+	write_file(t, actual, "edited\n", 0o644)
+	if class := classify(); class != dotfile_home_changed {
+		t.Errorf("edited in HOME: %s, want %s", class, dotfile_home_changed)
+	}
+	write_file(t, actual, "password one\n", 0o644)
+	before := record.Written_At.Add(-time.Minute)
+	if err := os.Chtimes(actual, before, before); err != nil {
+		t.Fatal(err)
+	}
+	encrypt("password two\n")
+	if class := classify(); class != dotfile_repo_changed {
+		t.Errorf("changed in the repo: %s, want %s", class, dotfile_repo_changed)
+	}
+	write_file(t, actual, "edited\n", 0o644)
+	if class := classify(); class != dotfile_conflict {
+		t.Errorf("changed on both sides: %s, want %s", class, dotfile_conflict)
+	}
+
+	if err := backup_dotfile("run", actual, true); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(backups_dir(), "run", ".netrc"))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("backup of a decrypted dotfile: %v, %v, want mode 0600", info, err)
+	}
+}
+
+func Test_Match_Dotfile_Glob(t *testing.T) {
+	for _, test := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{".config/fish/fish_variables", ".config/fish/fish_variables", true},
+		{".config/fish/fish_variables", "x/.config/fish/fish_variables", false},
+		{"*.sh", "bin/deploy.sh", true},
+		{"*.sh", "deploy.sh", true},
+		{"*.sh", "deploy.shx", false},
+		{".local/bin/*", ".local/bin/deploy", true},
+		{".local/bin/*", ".local/bin/tools/deploy", false},
+		{".local/bin/**", ".local/bin/tools/deploy", true},
+		{"**/id_*", ".ssh/keys/id_ed25519", true},
+		{".config/**/config", ".config/config", true},
+		{".config/**/config", ".config/a/b/config", true},
+		{".config/**/config", ".config/a/b/config.bak", false},
+	} {
+		if got := match_dotfile_glob(test.pattern, test.name); got != test.want {
+			t.Errorf("match_dotfile_glob(%q, %q) = %v, want %v", test.pattern, test.name, got, test.want)
+		}
+	}
+}
+
+func Test_Dotfile_Mode(t *testing.T) {
+	dotfiles_sandbox(t)
+	write_file(t, dotfile_rules_path(), "*.sh mode=0750\n.local/bin/private mode=0700\n.config/shared mode=0666\n", 0o644)
+	common := filepath.Join(big_bang_dotfiles_root, "common")
+	for _, test := range []struct {
+		relative string
+		repo     os.FileMode
+		want     os.FileMode
+	}{
+		{".profile", 0o644, 0o644},
+		{".local/bin/tool", 0o755, 0o755},
+		// Git only keeps the executable bit so anything else in the checkout is ignored.
+		{".profile_private", 0o600, 0o644},
+		{".local/bin/deploy.sh", 0o644, 0o750},
+		{".local/bin/private", 0o755, 0o700},
+		{".config/shared", 0o644, 0o666},
+		{".ssh/config", 0o644, 0o600},
+		{".ssh/bin/helper", 0o755, 0o700},
+		{".netrc.enc", 0o644, 0o600},
+	} {
+		expect := filepath.Join(common, test.relative)
+		write_file(t, expect, "", test.repo)
+		if err := os.Chmod(expect, test.repo); err != nil {
+			t.Fatal(err)
+		}
+		actual := filepath.Join(HOME, dotfile_destination_name(test.relative))
+		if got, err := dotfile_mode(expect, actual); err != nil || got != test.want {
+			t.Errorf("dotfile_mode(%s) = %#o, %v, want %#o", test.relative, got, err, test.want)
+		}
+	}
+}
+
+func Test_Classify_Symlinked_Dotfile(t *testing.T) {
+	dotfiles_sandbox(t)
+	expect := filepath.Join(big_bang_dotfiles_root, "common", ".config", "nvim", "lazy-lock.json")
+	actual := filepath.Join(HOME, ".config", "nvim", "lazy-lock.json")
+	write_file(t, expect, "{}\n", 0o644)
+	if err := os.MkdirAll(filepath.Dir(actual), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(expect, actual); err != nil {
+		t.Fatal(err)
+	}
+	state := &State{Dotfiles: map[string]Dotfile_Record{}}
+	state.record_dotfile_symlink(expect, actual)
+	// The rules used to symlink the file and now copy it.
+	if dotfile_matches(expect, actual) {
+		t.Error("a symlink matches a dotfile that is copied")
+	}
+	if class, err := classify_dotfile(state, expect, actual); err != nil || class != dotfile_repo_changed {
+		t.Errorf("classify_dotfile = %q, %v, want %q", class, err, dotfile_repo_changed)
+	}
+
+	if err := os.Remove(actual); err != nil {
+		t.Fatal(err)
+	}
+	write_file(t, actual, "{\"edited\": true}\n", 0o644)
+	if class, err := classify_dotfile(state, expect, actual); err != nil || class != dotfile_home_changed {
+		t.Errorf("classify_dotfile of a link replaced by a file = %q, %v, want %q", class, err, dotfile_home_changed)
+	}
+}
+
+func Test_Dotfile_Rules_Are_Read_Once(t *testing.T) {
+	dotfiles_sandbox(t)
+	write_file(t, dotfile_rules_path(), "*.sh mode=0700\n", 0o644)
+	expect := filepath.Join(big_bang_dotfiles_root, "common", "deploy.sh")
+	write_file(t, expect, "", 0o644)
+	actual := filepath.Join(HOME, "deploy.sh")
+	if mode, err := dotfile_mode(expect, actual); err != nil || mode != 0o700 {
+		t.Fatalf("dotfile_mode = %#o, %v, want 0700", mode, err)
+	}
+	write_file(t, dotfile_rules_path(), "*.sh mode=0755 strategy=symlink\n", 0o644)
+	mode, err := dotfile_mode(expect, actual)
+	strategy, _ := dotfile_strategy(expect, actual)
+	if err != nil || mode != 0o700 || strategy != strategy_copy {
+		t.Errorf("after editing the rules mid-run: %#o %s, %v, want the rules from the start of the run", mode, strategy, err)
+	}
+}
+
+func Test_Load_Ignore_File(t *testing.T) {
+	dir := t.TempDir()
+	ignore_file := filepath.Join(dir, ".bigbangignore")
+	write_file(t, ignore_file, "# comment\n\n*.swp\n!keep.swp\n/README.md\ncache/\ndocs/*.md\n[!a]bc\n\\#notes \ntrailing\\ \n[\n", 0o644)
+	patterns, err := load_ignore_file(ignore_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Ignore_Pattern{
+		{Dir: dir, Glob: "*.swp"},
+		{Dir: dir, Glob: "keep.swp", Negate: true},
+		{Dir: dir, Glob: "README.md", Anchored: true},
+		{Dir: dir, Glob: "cache", Dir_Only: true},
+		{Dir: dir, Glob: "docs/*.md", Anchored: true},
+		{Dir: dir, Glob: "[^a]bc"},
+		{Dir: dir, Glob: "#notes"},
+		{Dir: dir, Glob: "trailing "},
+	}
+	if !slices.Equal(patterns, want) {
+		t.Errorf("load_ignore_file =\n%v\nwant\n%v", patterns, want)
+	}
+	if patterns, err := load_ignore_file(filepath.Join(dir, "missing")); err != nil || patterns != nil {
+		t.Errorf("load_ignore_file of a missing file = %v, %v", patterns, err)
+	}
+}
+
+func Test_Is_Ignored(t *testing.T) {
+	root := t.TempDir()
+	layer := filepath.Join(root, "debian")
+	write_file(t, filepath.Join(root, ".gitignore"), "*.swp\n.DS_Store\n", 0o644)
+	write_file(t, filepath.Join(layer, ".bigbangignore"), "!keep.swp\n/README.md\n.config/waybar/README.md\ncache/\n", 0o644)
+	var patterns []Ignore_Pattern
+	for _, ignore_file := range []string{filepath.Join(root, ".gitignore"), filepath.Join(layer, ".bigbangignore")} {
+		loaded, err := load_ignore_file(ignore_file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patterns = append(patterns, loaded...)
+	}
+	for _, test := range []struct {
+		relative string
+		is_dir   bool
+		want     bool
+	}{
+		{".config/fish/config.fish", false, false},
+		{".config/fish/.config.fish.swp", false, true},
+		{".DS_Store", false, true},
+		{".config/.DS_Store", false, true},
+		{"keep.swp", false, false},
+		{".local/keep.swp", false, false},
+		{"README.md", false, true},
+		{".config/README.md", false, false},
+		{".config/waybar/README.md", false, true},
+		{".cache/cache", true, true},
+		{".cache/cache", false, false},
+	} {
+		if got := is_ignored(patterns, filepath.Join(layer, test.relative), test.is_dir); got != test.want {
+			t.Errorf("is_ignored(%s, dir=%v) = %v, want %v", test.relative, test.is_dir, got, test.want)
+		}
+	}
+	// Patterns only apply below the directory of their file.
+	if is_ignored(patterns, filepath.Join(root, "README.md"), false) {
+		t.Error("a layer's ignore file applied outside the layer")
+	}
+}
+
+// A file:// GOPROXY serving example.com/hello at v1.0.0, a main package that prints hello.
+func go_proxy_with_hello_module(t *testing.T) (proxy string) {
+	t.Helper()
+	if which("go") == "" {
+		t.Skip("go is not installed")
+	}
+	proxy = t.TempDir()
+	versions := filepath.Join(proxy, "example.com", "hello", "@v")
+	go_mod := "module example.com/hello\n\ngo 1.25\n"
+	write_file(t, filepath.Join(versions, "list"), "v1.0.0\n", 0o644)
+	write_file(t, filepath.Join(versions, "v1.0.0.info"), `{"Version":"v1.0.0","Time":"2025-01-01T00:00:00Z"}`, 0o644)
+	write_file(t, filepath.Join(versions, "v1.0.0.mod"), go_mod, 0o644)
+	archive, err := os.Create(filepath.Join(versions, "v1.0.0.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := zip.NewWriter(archive)
+	for name, contents := range map[string]string{
+		"go.mod":  go_mod,
+		"main.go": "package main\n\nfunc main() { println(\"hello\") }\n",
+	} {
+		file, err := writer.Create("example.com/hello@v1.0.0/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(contents))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive.Close()
+
+	module_cache := t.TempDir()
+	t.Setenv("GOPROXY", "file://"+filepath.ToSlash(proxy))
+	t.Setenv("GOSUMDB", "off")
+	t.Setenv("GOTOOLCHAIN", "local")
+	t.Setenv("GOMODCACHE", module_cache)
+	// The module cache is read-only so t.TempDir can't remove it by itself.
+	t.Cleanup(func() { exec.Command("go", "clean", "-modcache").Run() })
+	return proxy
+}
+
+func Test_Install_Go_Install(t *testing.T) {
+	go_proxy_with_hello_module(t)
+	set_global(t, &BIG_BANG_DATA_DIR, t.TempDir())
+	set_global(t, &BIG_BANG_BIN, filepath.Join(BIG_BANG_DATA_DIR, "bin"))
+	set_global(t, &BIG_BANG_TMP, filepath.Join(BIG_BANG_DATA_DIR, "tmp"))
+	for _, dir := range []string{BIG_BANG_BIN, BIG_BANG_TMP} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", BIG_BANG_BIN+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	artifact := Artifact{Name: "hello", Go_Install: &Go_Install{Package: "example.com/hello", Version: "v1.0.0"}}
+
+	installed, ok := install_go_install(artifact, quiet_logger())
+	binary := filepath.Join(BIG_BANG_BIN, "hello")
+	if !ok || !slices.Equal(installed, []string{binary}) {
+		t.Fatalf("install_go_install = %v, %v, want %v", installed, ok, []string{binary})
+	}
+	if err := go_install_healthcheck(t.Context(), &artifact); err != nil {
+		t.Errorf("health check after installing: %v", err)
+	}
+	for _, recipe := range []Go_Install{
+		{Package: "example.com/hello", Version: "v1.0.1"},
+		{Package: "example.com/hello", Module: "example.com/other", Version: "v1.0.0"},
+		{Package: "example.com/hello/cmd/hello", Module: "example.com/hello", Version: "v1.0.0"},
+	} {
+		if err := recipe.matches_build_info(t.Context(), binary); err == nil {
+			t.Errorf("matches_build_info(%+v) accepted a binary built from example.com/hello@v1.0.0", recipe)
+		}
+	}
+}
+
+func Test_Check_Install_List(t *testing.T) {
+	recipe := Cargo_Install{Crate: "stylua", Version: "2.1.0", Binaries: []string{"stylua"}}
+	for _, test := range []struct {
+		name   string
+		output string
+		ok     bool
+	}{
+		{"installed", "stylua v2.1.0:\n    stylua\n", true},
+		{"among others", "ripgrep v14.1.1:\n    rg\nstylua v2.1.0:\n    stylua\ntaplo-cli v0.9.3:\n    taplo\n", true},
+		{"from a path", "stylua v2.1.0 (/src/stylua):\n    stylua\n", true},
+		{"wrong version", "stylua v2.0.0:\n    stylua\n", false},
+		{"missing binary", "stylua v2.1.0:\n    stylua-lsp\n", false},
+		{"another crate's binary", "stylua v2.1.0:\nother v1.0.0:\n    stylua\n", false},
+		{"not installed", "ripgrep v14.1.1:\n    rg\n", false},
+		{"nothing installed", "", false},
+	} {
+		if err := recipe.check_install_list(test.output, "/root"); (err == nil) != test.ok {
+			t.Errorf("%s: check_install_list = %v, want ok = %v", test.name, err, test.ok)
+		}
+	}
+}
+
+// Installs a crate from a directory source that stands in for crates.io, so nothing is downloaded.
+func Test_Install_Cargo_Install(t *testing.T) {
+	if which("cargo") == "" {
+		t.Skip("cargo is not installed")
+	}
+	registry := t.TempDir()
+	crate := filepath.Join(registry, "hello-0.1.0")
+	write_file(t, filepath.Join(crate, "Cargo.toml"), "[package]\nname = \"hello\"\nversion = \"0.1.0\"\nedition = \"2021\"\n", 0o644)
+	write_file(t, filepath.Join(crate, "src", "main.rs"), "fn main() { println!(\"hello\"); }\n", 0o644)
+	write_file(t, filepath.Join(crate, ".cargo-checksum.json"), `{"files":{},"package":"`+strings.Repeat("0", 64)+`"}`, 0o644)
+	cargo_home := t.TempDir()
+	config := "[source.crates-io]\nreplace-with = \"local\"\n[source.local]\ndirectory = \"" + filepath.ToSlash(registry) + "\"\n"
+	write_file(t, filepath.Join(cargo_home, "config.toml"), config, 0o644)
+	if os.Getenv("RUSTUP_HOME") == "" {
+		// rustup would otherwise look for its toolchains next to the new CARGO_HOME.
+		if home, err := os.UserHomeDir(); err == nil {
+			t.Setenv("RUSTUP_HOME", filepath.Join(home, ".rustup"))
+		}
+	}
+	t.Setenv("CARGO_HOME", cargo_home)
+	t.Setenv("CARGO_NET_OFFLINE", "true")
+	set_global(t, &BIG_BANG_DATA_DIR, t.TempDir())
+	set_global(t, &BIG_BANG_SHARE, filepath.Join(BIG_BANG_DATA_DIR, "share"))
+	set_global(t, &BIG_BANG_BIN, filepath.Join(BIG_BANG_DATA_DIR, "bin"))
+	set_global(t, &BIG_BANG_TMP, filepath.Join(BIG_BANG_DATA_DIR, "tmp"))
+	for _, dir := range []string{BIG_BANG_SHARE, BIG_BANG_BIN, BIG_BANG_TMP} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", BIG_BANG_BIN+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	artifact := Artifact{Name: "hello", Cargo_Install: &Cargo_Install{Crate: "hello", Version: "0.1.0"}}
+
+	installed, ok := install_cargo_install(artifact, quiet_logger())
+	binary := filepath.Join(BIG_BANG_BIN, "hello")
+	root := filepath.Join(BIG_BANG_SHARE, "cargo-installs", "hello")
+	if !ok || !slices.Equal(installed, []string{binary, root}) {
+		t.Fatalf("install_cargo_install = %v, %v, want %v", installed, ok, []string{binary, root})
+	}
+	if err := cargo_install_healthcheck(t.Context(), &artifact); err != nil {
+		t.Errorf("health check after installing: %v", err)
+	}
+	wrong := Cargo_Install{Crate: "hello", Version: "0.2.0"}
+	if err := wrong.matches_install_list(t.Context(), root); err == nil {
+		t.Error("matches_install_list accepted the wrong version")
+	}
+}
+
+func Test_Health_Cache_Probe(t *testing.T) {
+	set_global(t, &health_probe_timeout, 200*time.Millisecond)
+	broken := errors.New("broken")
+	artifacts := map[string]Artifact{}
+	slow := []string{"slow0", "slow1", "slow2"}
+	for _, name := range slow {
+		artifacts[name] = Artifact{Name: name, Checkhealth: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}}
+	}
+	for i := range 2 * health_probe_workers {
+		name := "fast" + strconv.Itoa(i)
+		reason := error(nil)
+		if i%2 == 1 {
+			reason = broken
+		}
+		artifacts[name] = Artifact{Name: name, Checkhealth: func(ctx context.Context) error { return reason }}
+	}
+
+	cache := &Health_Cache{}
+	start := time.Now()
+	cache.probe(artifacts, quiet_logger())
+	elapsed := time.Since(start)
+
+	for _, name := range slow {
+		if reason := cache.get(name); reason == nil || !strings.Contains(reason.Error(), "timed out") {
+			t.Errorf("%s: got %v, want a timeout", name, reason)
+		}
+	}
+	for i := range 2 * health_probe_workers {
+		name := "fast" + strconv.Itoa(i)
+		want := error(nil)
+		if i%2 == 1 {
+			want = broken
+		}
+		if got := cache.get(name); got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+	if elapsed >= 2*health_probe_timeout {
+		t.Errorf("probe took %s, expected about one timeout of %s", elapsed, health_probe_timeout)
+	}
+}
+
+func Test_State_Round_Trip(t *testing.T) {
+	set_global(t, &BIG_BANG_DATA_DIR, t.TempDir())
+
+	state, err := load_state()
+	if err != nil {
+		t.Fatalf("loading a missing state file: %v", err)
+	}
+	if state.Schema_Version != state_schema_version || len(state.Artifacts) != 0 || len(state.Dotfiles) != 0 {
+		t.Fatalf("a missing state file loaded as %+v, want an empty state", state)
+	}
+
+	written_at := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	state.Artifacts["rg"] = Artifact_Record{
+		Version:      "14.1.1",
+		Source_URL:   "https://example.com/rg.tar.gz",
+		Files:        []Installed_File{{Path: "/bin/rg", Sha256: "abc"}, {Path: "/man/rg.1", Symlink: "/share/rg/rg.1"}},
+		Installed_At: written_at,
+	}
+	state.Dotfiles["/home/.bashrc"] = Dotfile_Record{Source: "bashrc", Sha256: "def", Written_At: written_at}
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+	leftovers, err := filepath.Glob(filepath.Join(BIG_BANG_DATA_DIR, ".state.json.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers) != 0 {
+		t.Errorf("save left temporary files behind: %v", leftovers)
+	}
+
+	loaded, err := load_state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := loaded.Artifacts["rg"], state.Artifacts["rg"]; got.Version != want.Version || got.Source_URL != want.Source_URL ||
+		!slices.Equal(got.Files, want.Files) || !got.Installed_At.Equal(want.Installed_At) {
+		t.Errorf("artifact record: got %+v, want %+v", got, want)
+	}
+	if got, want := loaded.Dotfiles["/home/.bashrc"], state.Dotfiles["/home/.bashrc"]; got != want {
+		t.Errorf("dotfile record: got %+v, want %+v", got, want)
+	}
+
+	for _, version := range []int{state_schema_version + 1, 0, -1} {
+		contents := []byte(`{"schema_version": ` + strconv.Itoa(version) + `}`)
+		if err := os.WriteFile(state_file_path(), contents, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := load_state(); err == nil {
+			t.Errorf("schema version %d: expected an error", version)
+		}
+	}
+}
+
+func Test_Run_Report_Exit_Code(t *testing.T) {
+	entry := func(outcome string) Report_Entry {
+		return Report_Entry{Kind: "artifact", Name: outcome, Outcome: outcome}
+	}
+	for _, test := range []struct {
+		name    string
+		entries []Report_Entry
+		command int
+		want    int
+	}{
+		{"empty run", nil, exit_ok, exit_ok},
+		{
+			"nothing failed",
+			[]Report_Entry{
+				entry(outcome_unchanged), entry(outcome_installed), entry(outcome_upgraded), entry(outcome_removed), entry(outcome_skipped),
+			},
+			exit_ok, exit_ok,
+		},
+		{"one failure", []Report_Entry{entry(outcome_installed), entry(outcome_failed)}, exit_ok, exit_failure},
+		{"command failed on its own", []Report_Entry{entry(outcome_unchanged)}, exit_failure, exit_failure},
+		{"usage error", nil, exit_usage, exit_usage},
+		{"usage error with failures", []Report_Entry{entry(outcome_failed)}, exit_usage, exit_usage},
+		{"setup error", nil, exit_setup, exit_setup},
+		{"setup error with failures", []Report_Entry{entry(outcome_failed)}, exit_setup, exit_setup},
+	} {
+		report := &Run_Report{Entries: test.entries}
+		if got := report.exit_code(test.command); got != test.want {
+			t.Errorf("%s: exit code %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// Hands the answer over after running edit, as if the user had changed something while the prompt was up.
+type Edit_While_Asking struct {
+	edit   func()
+	answer io.Reader
+}
+
+func (reader *Edit_While_Asking) Read(buffer []byte) (int, error) {
+	if reader.edit != nil {
+		reader.edit()
+		reader.edit = nil
+	}
+	return reader.answer.Read(buffer)
+}
+
+func Test_Stale_Dotfiles(t *testing.T) {
+	dotfiles_sandbox(t)
+	t.Setenv("BIG_BANG_PROFILES", "")
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	set_global(t, &os.Stdout, stdout)
+	write_file(t, filepath.Join(big_bang_dotfiles_root, "common", ".kept"), "kept\n", 0o644)
+	// Not applied on this machine but still in the repo.
+	write_file(t, filepath.Join(big_bang_dotfiles_root, "profiles", "work", ".work"), "work\n", 0o644)
+	write_file(t, filepath.Join(big_bang_dotfiles_root, "hosts", "elsewhere", ".host"), "host\n", 0o644)
+
+	state := &State{Dotfiles: make(map[string]Dotfile_Record)}
+	record := func(name, contents string) string {
+		destination := filepath.Join(HOME, name)
+		write_file(t, destination, contents, 0o644)
+		if err := state.record_dotfile(filepath.Join(big_bang_dotfiles_root, "common", name), destination, []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		return destination
+	}
+	record(".kept", "kept\n")
+	record(".work", "work\n")
+	record(".host", "host\n")
+	unchanged := record(".unchanged", "unchanged\n")
+	modified := record(".modified", "modified\n")
+	write_file(t, modified, "edited\n", 0o644)
+	missing := record(".missing", "missing\n")
+	if err := os.Remove(missing); err != nil {
+		t.Fatal(err)
+	}
+	edited_later := record(".edited_later", "edited later\n")
+
+	stale, err := stale_dotfiles(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]string)
+	for _, entry := range stale {
+		kinds[entry.Path] = entry.Kind
+	}
+	want := map[string]string{
+		unchanged:    stale_unchanged,
+		modified:     stale_modified,
+		missing:      stale_missing,
+		edited_later: stale_unchanged,
+	}
+	if !maps.Equal(kinds, want) {
+		t.Fatalf("stale_dotfiles = %v, want %v", kinds, want)
+	}
+
+	set_global(t, &stdin, bufio.NewReader(&Edit_While_Asking{
+		edit:   func() { write_file(t, edited_later, "edited while asking\n", 0o644) },
+		answer: strings.NewReader("y\n"),
+	}))
+	report := &Run_Report{}
+	remove_stale_dotfiles(state, report, quiet_logger(), Sync_Options{Interactive: true, Run_Id: "2025-06-10T12-00-00.000Z"})
+	outcomes := make(map[string]string)
+	for _, entry := range report.Entries {
+		outcomes[entry.Name] = entry.Outcome
+	}
+	want = map[string]string{unchanged: outcome_removed, modified: outcome_skipped, edited_later: outcome_failed}
+	if !maps.Equal(outcomes, want) {
+		t.Errorf("outcomes = %v, want %v", outcomes, want)
+	}
+	if file_exists(unchanged) {
+		t.Errorf("%s was not removed", unchanged)
+	}
+	for _, path := range []string{modified, edited_later, filepath.Join(HOME, ".work"), filepath.Join(HOME, ".host")} {
+		if !file_exists(path) {
+			t.Errorf("%s was removed", path)
+		}
+	}
+	for path, want := range map[string]bool{unchanged: false, missing: false, modified: true, edited_later: true} {
+		if _, ok := state.Dotfiles[path]; ok != want {
+			t.Errorf("%s is recorded: %v, want %v", path, ok, want)
+		}
+	}
+}
+
+func Test_Backup_And_Restore(t *testing.T) {
+	dotfiles_sandbox(t)
+	t.Setenv("BIG_BANG_PROFILES", "")
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	set_global(t, &os.Stdout, stdout)
+	expect := filepath.Join(big_bang_dotfiles_root, "common", ".profile")
+	actual := filepath.Join(HOME, ".profile")
+	write_file(t, expect, "old\n", 0o644)
+	write_file(t, actual, "old\n", 0o640)
+	state := &State{Dotfiles: make(map[string]Dotfile_Record)}
+	if err := state.record_dotfile(expect, actual, []byte("old\n")); err != nil {
+		t.Fatal(err)
+	}
+	write_file(t, expect, "new\n", 0o644)
+
+	run_id := "2025-06-10T12-00-00.000Z"
+	report := &Run_Report{}
+	sync_dotfiles(state, report, quiet_logger(), Sync_Options{Run_Id: run_id, Conflict: conflict_ask})
+	if report.failed() {
+		t.Fatalf("sync failed: %+v", report.Entries)
+	}
+	if contents, _ := os.ReadFile(actual); string(contents) != "new\n" {
+		t.Fatalf("sync wrote %q, want the repo's contents", contents)
+	}
+	backup := filepath.Join(backups_dir(), run_id, ".profile")
+	if contents, err := os.ReadFile(backup); err != nil || string(contents) != "old\n" {
+		t.Errorf("backup has %q, %v, want what was overwritten", contents, err)
+	}
+
+	// The restore has to reset the mode of the file it writes over.
+	if err := os.Chmod(actual, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if exit_code := command_restore(quiet_logger(), []string{run_id, actual}); exit_code != exit_ok {
+		t.Fatalf("restore exited with %d", exit_code)
+	}
+	if contents, _ := os.ReadFile(actual); string(contents) != "old\n" {
+		t.Errorf("restored %q, want the backed up contents", contents)
+	}
+	if info, err := os.Stat(actual); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("restored file has mode %v, %v, want 0640", info.Mode().Perm(), err)
+	}
+	// The overwritten file is backed up too so the restore can be undone.
+	backups, err := list_backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[1].Id != run_id || !slices.Equal(backups[0].Files, []string{".profile"}) {
+		t.Errorf("list_backups = %+v, want the restore's undo backup before the sync's", backups)
+	}
+}
+
+func Test_Prune_Backups(t *testing.T) {
+	set_global(t, &BIG_BANG_DATA_DIR, t.TempDir())
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	set_global(t, &os.Stdout, stdout)
+	now := time.Now().UTC()
+	var ids []string
+	for _, age := range []time.Duration{time.Hour, 2 * time.Hour, 72 * time.Hour, 96 * time.Hour} {
+		id := now.Add(-age).Format(run_log_time_format)
+		ids = append(ids, id)
+		write_file(t, filepath.Join(backups_dir(), id, ".profile"), "old\n", 0o644)
+	}
+	kept := func() (ids []string) {
+		backups, err := list_backups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, backup := range backups {
+			ids = append(ids, backup.Id)
+		}
+		return ids
+	}
+
+	if exit_code := command_backups_prune(quiet_logger(), []string{"--keep=3", "--yes"}); exit_code != exit_ok {
+		t.Fatalf("prune exited with %d", exit_code)
+	}
+	if got := kept(); !slices.Equal(got, ids[:3]) {
+		t.Errorf("--keep=3 kept %v, want %v", got, ids[:3])
+	}
+	if exit_code := command_backups_prune(quiet_logger(), []string{"--max-age=1", "--yes"}); exit_code != exit_ok {
+		t.Fatalf("prune exited with %d", exit_code)
+	}
+	if got := kept(); !slices.Equal(got, ids[:2]) {
+		t.Errorf("--max-age=1 kept %v, want %v", got, ids[:2])
+	}
+}
+
+func Test_Copy_File_Resets_Mode(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source")
+	destination := filepath.Join(dir, "destination")
+	write_file(t, source, "secret\n", 0o600)
+	write_file(t, destination, "old contents that are longer\n", 0o644)
+	if err := copy_file(source, destination, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := os.ReadFile(destination); string(contents) != "secret\n" {
+		t.Errorf("destination has %q", contents)
+	}
+	if info, err := os.Stat(destination); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("destination has mode %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+}
+
+func Test_Sync_Diff_Only_Shows_Written_Dotfiles(t *testing.T) {
+	dotfiles_sandbox(t)
+	t.Setenv("BIG_BANG_PROFILES", "")
+	stdout_path := filepath.Join(t.TempDir(), "stdout")
+	stdout, err := os.Create(stdout_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	set_global(t, &os.Stdout, stdout)
+	state := &State{Dotfiles: make(map[string]Dotfile_Record)}
+	// Each file starts out as synced then the repo, HOME, or both change.
+	for name, change := range map[string][2]string{
+		".repo":     {"repo edit\n", ""},
+		".home":     {"", "home edit\n"},
+		".conflict": {"conflict repo edit\n", "conflict home edit\n"},
+	} {
+		expect := filepath.Join(big_bang_dotfiles_root, "common", name)
+		actual := filepath.Join(HOME, name)
+		write_file(t, actual, "synced\n", 0o644)
+		if err := state.record_dotfile(expect, actual, []byte("synced\n")); err != nil {
+			t.Fatal(err)
+		}
+		write_file(t, expect, cmp.Or(change[0], "synced\n"), 0o644)
+		if change[1] != "" {
+			write_file(t, actual, change[1], 0o644)
+		}
+	}
+
+	report := &Run_Report{}
+	sync_dotfiles(state, report, quiet_logger(), Sync_Options{Diff: true, Conflict: conflict_ask, Run_Id: "2025-06-10T12-00-00.000Z"})
+	output, err := os.ReadFile(stdout_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(output), "+repo edit") {
+		t.Errorf("the diff of the written dotfile is missing:\n%s", output)
+	}
+	if strings.Contains(string(output), "conflict repo edit") || strings.Contains(string(output), "home edit") {
+		t.Errorf("dotfiles that aren't written were diffed:\n%s", output)
+	}
+	for _, line := range []string{
+		display_home_path(filepath.Join(HOME, ".home")) + ": " + skip_reason_home_changed,
+		display_home_path(filepath.Join(HOME, ".conflict")) + ": " + skip_reason_conflict,
+	} {
+		if !strings.Contains(string(output), line) {
+			t.Errorf("output is missing %q:\n%s", line, output)
+		}
+	}
+	if contents, _ := os.ReadFile(filepath.Join(HOME, ".repo")); string(contents) != "repo edit\n" {
+		t.Errorf(".repo has %q, want the repo's contents", contents)
+	}
+}
+
+func Test_Dotfile_Passphrase_Keyfile_Mode(t *testing.T) {
+	set_global(t, &BIG_BANG_DATA_DIR, t.TempDir())
+	set_global(t, &dotfile_secrets.passphrase, "")
+	for _, test := range []struct {
+		mode os.FileMode
+		ok   bool
+	}{
+		{0o600, true},
+		{0o400, true},
+		{0o640, false},
+		{0o604, false},
+		{0o644, false},
+	} {
+		dotfile_secrets.passphrase = ""
+		write_file(t, dotfile_keyfile_path(), "passphrase\n", test.mode)
+		if err := os.Chmod(dotfile_keyfile_path(), test.mode); err != nil {
+			t.Fatal(err)
+		}
+		passphrase, err := dotfile_passphrase(false)
+		if (err == nil) != test.ok || (test.ok && passphrase != "passphrase") {
+			t.Errorf("mode %04o: dotfile_passphrase = %q, %v", test.mode, passphrase, err)
+		}
+		if err := os.Remove(dotfile_keyfile_path()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}